@@ -2,18 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"math"
+	"math/big"
+	"math/bits"
+	"math/cmplx"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 //------------------------------------------------------------
@@ -154,6 +165,243 @@ func (p DescendingPairList) Len() int           { return len(p) }
 func (p DescendingPairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p DescendingPairList) Less(i, j int) bool { return Compare(p[i].Value, p[j].Value) == 1 }
 
+/*------------------------------------------------------------*/
+/*
+	Dict is the GoForth dictionary type. Keys are hashed structurally so
+	lists and dicts can be used as keys, and keys that are numerically equal
+	like 1, 1.0 and 1/1 refer to the same entry, consistent with Compare.
+	The one exception is that Compare converts between strings and numbers
+	but keys don't, so "1" and 1 are different keys. Entries are kept in
+	insertion order so iterating and printing a dictionary always produces
+	the same output.
+*/
+type Dict struct {
+	buckets map[uint64][]*DictEntry
+	entries []*DictEntry
+}
+
+// DictEntry is a single key/value pair in a dictionary
+type DictEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// NewDict creates an empty dictionary with room for size entries
+func NewDict(size int) *Dict {
+	return &Dict{
+		buckets: make(map[uint64][]*DictEntry, size),
+		entries: make([]*DictEntry, 0, size),
+	}
+}
+
+func (d *Dict) find(key interface{}) (uint64, *DictEntry) {
+	h := hashValue(key)
+	for _, e := range d.buckets[h] {
+		if keysEqual(e.Key, key) {
+			return h, e
+		}
+	}
+	return h, nil
+}
+
+// Get looks up the value for a key
+func (d *Dict) Get(key interface{}) (interface{}, bool) {
+	_, e := d.find(key)
+	if e == nil {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Set adds or replaces the value for a key
+func (d *Dict) Set(key interface{}, value interface{}) {
+	h, e := d.find(key)
+	if e != nil {
+		e.Value = value
+		return
+	}
+	e = &DictEntry{Key: key, Value: value}
+	d.buckets[h] = append(d.buckets[h], e)
+	d.entries = append(d.entries, e)
+}
+
+// PopOldest removes the entry that was added first and returns it, or
+// nil if the dictionary is empty
+func (d *Dict) PopOldest() *DictEntry {
+	if len(d.entries) == 0 {
+		return nil
+	}
+	e := d.entries[0]
+	d.entries[0] = nil
+	d.entries = d.entries[1:]
+	h := hashValue(e.Key)
+	bucket := d.buckets[h]
+	for i, be := range bucket {
+		if be == e {
+			bucket = append(bucket[:i:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(d.buckets, h)
+	} else {
+		d.buckets[h] = bucket
+	}
+	return e
+}
+
+// Len returns the number of entries in the dictionary
+func (d *Dict) Len() int {
+	return len(d.entries)
+}
+
+// Entries returns the key/value pairs in the dictionary in insertion order.
+// The returned slice must not be modified.
+func (d *Dict) Entries() []*DictEntry {
+	return d.entries
+}
+
+func (d *Dict) String() string {
+	var sb strings.Builder
+	sb.WriteString("map[")
+	for i, e := range d.Entries() {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%v:%v", e.Key, e.Value)
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+var dictType = reflect.TypeOf(NewDict(0))
+
+// hashValue computes a structural hash for a value. Values that are equal
+// according to keysEqual always have the same hash.
+func hashValue(val interface{}) uint64 {
+	if items, ok := persistentItems(val); ok {
+		val = items
+	}
+	h := fnv.New64a()
+	switch v := val.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 2
+	case string:
+		h.Write([]byte{'s'})
+		h.Write([]byte(v))
+	case Bytes:
+		h.Write([]byte{'b'})
+		h.Write(v)
+	case time.Time:
+		fmt.Fprintf(h, "t%d", v.UnixNano())
+	case *Symbol:
+		h.Write([]byte{':'})
+		h.Write([]byte(v.Name))
+	case *Record:
+		h.Write([]byte{'r'})
+		h.Write([]byte(v.Type.Name))
+		return h.Sum64()*1099511628211 ^ hashValue(v.Values)
+	case []interface{}:
+		h.Write([]byte{'l'})
+		result := h.Sum64()
+		for _, e := range v {
+			result = result*1099511628211 ^ hashValue(e)
+		}
+		return result
+	case *Dict:
+		// Combine the entries in an order-independent way
+		var result uint64 = 'd'
+		for _, e := range v.Entries() {
+			result += hashValue(e.Key)*31 ^ hashValue(e.Value)
+		}
+		return result
+	default:
+		if numericRank(val) != rankNone {
+			h.Write([]byte{'n'})
+			h.Write([]byte(numericKey(val)))
+		} else {
+			fmt.Fprintf(h, "%T:%v", val, val)
+		}
+	}
+	return h.Sum64()
+}
+
+// numericKey returns a canonical string for a number so that numerically
+// equal values of different types hash the same.
+func numericKey(val interface{}) string {
+	if c, ok := val.(complex128); ok {
+		if imag(c) != 0 {
+			return fmt.Sprint(c)
+		}
+		val = real(c)
+	}
+	r, ok := exactRat(val)
+	if !ok {
+		return fmt.Sprint(val)
+	}
+	return r.RatString()
+}
+
+// keysEqual tests two values for structural equality. Unlike Compare it never
+// coerces between strings and numbers and never fails.
+func keysEqual(v1 interface{}, v2 interface{}) bool {
+	if v1 == nil || v2 == nil {
+		return v1 == nil && v2 == nil
+	}
+	if numericRank(v1) != rankNone && numericRank(v2) != rankNone {
+		return compareNumbers(v1, v2) == 0
+	}
+	if items, ok := persistentItems(v1); ok {
+		v1 = items
+	}
+	if items, ok := persistentItems(v2); ok {
+		v2 = items
+	}
+	switch x := v1.(type) {
+	case []interface{}:
+		y, ok := v2.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !keysEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case *Record:
+		y, ok := v2.(*Record)
+		return ok && x.Type == y.Type && keysEqual(x.Values, y.Values)
+	case *Dict:
+		y, ok := v2.(*Dict)
+		if !ok || x.Len() != y.Len() {
+			return false
+		}
+		for _, e := range x.Entries() {
+			val, found := y.Get(e.Key)
+			if !found || !keysEqual(e.Value, val) {
+				return false
+			}
+		}
+		return true
+	}
+	if reflect.TypeOf(v1) != reflect.TypeOf(v2) {
+		return false
+	}
+	if t, ok := v1.(time.Time); ok {
+		return t.Equal(v2.(time.Time))
+	}
+	if reflect.TypeOf(v1).Comparable() {
+		return v1 == v2
+	}
+	return reflect.DeepEqual(v1, v2)
+}
+
 /*------------------------------------------------------------*/
 
 // Token represents a token in the language
@@ -163,6 +411,10 @@ type Token struct {
 	Text   string
 	Line   int
 	Offset int
+
+	// Tokens made from data by 'list>quote' carry their value directly
+	IsValue bool
+	Value   interface{}
 }
 
 func (tok Token) GetCodeLine() (string, int) {
@@ -172,12 +424,9 @@ func (tok Token) GetCodeLine() (string, int) {
 			offset := tok.Offset
 			start := offset
 			end := offset
-			for start > 0 && text[start] != '\n' {
+			for start > 0 && text[start-1] != '\n' {
 				start--
 			}
-			if text[start] == '\n' {
-				start++
-			}
 			for end < len(text) && text[end] != '\n' {
 				end++
 			}
@@ -253,7 +502,7 @@ func ParseLine(text string) []Token {
 				continue
 			}
 
-			if len(strtemp) != 3 {
+			if utf8.RuneCountInString(strtemp) != 3 {
 				activeFunction = op{tok: Token{Text: text, File: currentFile, Name: strtemp, Line: lineno, Offset: offset}, fn: nil}
 				GfError("invalid number of characters in a character literal: %s", strtemp)
 				continue
@@ -343,10 +592,6 @@ func ParseLine(text string) []Token {
 
 		if chr == ' ' || chr == '\r' || chr == '\n' || chr == '\t' {
 			if len(strtemp) > 0 {
-				if len(strtemp) > 1 && strtemp[0] == ':' {
-					// Turn :foobar into "foobar"
-					strtemp = "\"" + string(strtemp[1:]) + "\""
-				}
 				result = append(result, Token{Text: text, File: currentFile, Name: strtemp, Line: lineno, Offset: offset})
 			}
 			strtemp = ""
@@ -366,6 +611,13 @@ func ParseLine(text string) []Token {
 		}
 
 		if chr == '"' {
+			if strtemp == "b" || strtemp == "x" || strtemp == "." || strtemp == "S" {
+				// Byte string literals b"..." and x"..." and Forth's ." ..."
+				// and S" ..." keep their prefix
+				strtemp += "\""
+				inString = true
+				continue
+			}
 			if len(strtemp) > 0 {
 				result = append(result, Token{Text: text, File: currentFile, Name: strtemp, Line: lineno, Offset: offset})
 			}
@@ -477,6 +729,9 @@ func ParseLine(text string) []Token {
 type Scope struct {
 	Parent    *Scope
 	Variables map[string]interface{}
+
+	// Names declared 'global' in this scope; they live in the root scope
+	Globals map[string]bool
 }
 
 func NewScope(parent *Scope) *Scope {
@@ -487,10 +742,18 @@ func NewScope(parent *Scope) *Scope {
 }
 
 func (s *Scope) Set(name string, value interface{}) {
+	if s.Globals[name] {
+		s.Root().Variables[name] = value
+		return
+	}
 	s.Variables[name] = value
 }
 
 func (s *Scope) Get(name string) (interface{}, bool) {
+	if s.Globals[name] {
+		val, ok := s.Root().Variables[name]
+		return val, ok
+	}
 	val, ok := s.Variables[name]
 	if ok {
 		return val, true
@@ -501,6 +764,25 @@ func (s *Scope) Get(name string) (interface{}, bool) {
 	return nil, false
 }
 
+// Root gets the outermost scope, where global variables live
+func (s *Scope) Root() *Scope {
+	for s.Parent != nil {
+		s = s.Parent
+	}
+	return s
+}
+
+// DeclareGlobal makes reads and writes of the name in this scope use the root scope
+func (s *Scope) DeclareGlobal(name string) {
+	if s.Parent == nil {
+		return
+	}
+	if s.Globals == nil {
+		s.Globals = make(map[string]bool)
+	}
+	s.Globals[name] = true
+}
+
 // VariableTable is the variable table
 var VariableTable = NewScope(nil)
 
@@ -510,6 +792,38 @@ var VariableTable = NewScope(nil)
 type op struct {
 	fn  func()
 	tok Token
+
+	// The source tokens of a {...} block so it can be turned back into data
+	code []Token
+}
+
+// String shows a block as its source, e.g. {1 +}
+func (o op) String() string {
+	if o.code == nil {
+		if o.tok.Name != "" {
+			return o.tok.Name
+		}
+		return "<op>"
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	afterOpener := true
+	for _, tok := range o.code {
+		name := tok.Name
+		if tok.IsValue {
+			if str, ok := tok.Value.(string); ok {
+				name = strconv.Quote(str)
+			}
+		}
+		closer := !tok.IsValue && (name == "}" || name == "]")
+		if !closer && !afterOpener {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(name)
+		afterOpener = !tok.IsValue && (name == "{" || name == "[")
+	}
+	sb.WriteByte('}')
+	return sb.String()
 }
 
 // Dictionary of name string to operator functions
@@ -600,6 +914,9 @@ func LoadFile(fileToRun string) {
 	}
 
 	oldFile := currentFile
+	oldBinding := earlyBinding
+	oldStrict := strictMode
+	oldForth := forthMode
 	currentFile = fileToRun
 	lineno = 1
 	text, err := ioutil.ReadFile(fileToRun)
@@ -608,12 +925,15 @@ func LoadFile(fileToRun string) {
 		return
 	}
 	fields := ParseLine(string(text))
-	_, body := Compile(fields, 0, "", nil)
+	body := compileUnit(fields)
 	CallStack.Push(Token{File: fileToRun, Name: fileToRun, Line: 1, Offset: 0})
 	Eval(body)
 	CallStack.Pop("scriptExit")
 	lineno = 1
 	currentFile = oldFile
+	earlyBinding = oldBinding
+	strictMode = oldStrict
+	forthMode = oldForth
 }
 
 /*------------------------------------------------------------*/
@@ -670,7 +990,7 @@ func InvokeDynamic(fn interface{}, tok Token) {
 // GfError handles GoForth errors using the value of the activeFunction variable for source context.
 //
 func GfError(str string, a ...interface{}) {
-	fmtStr := colorRed + "Calling '" + activeFunction.tok.Name + "': " + str + colorReset + "\n"
+	fmtStr := colorRed + "Calling '" + strings.ReplaceAll(activeFunction.tok.Name, "%", "%%") + "': " + str + colorReset + "\n"
 	fmt.Printf(fmtStr, a...)
 	fmt.Printf("%sAt: %s:%d\tfunc: '%s'%s\n", colorRed, activeFunction.tok.File, activeFunction.tok.Line, activeFunction.tok.Name, colorReset)
 	codeline, pos := activeFunction.tok.GetCodeLine()
@@ -704,6 +1024,331 @@ func GfError(str string, a ...interface{}) {
 	loop = false
 }
 
+/*------------------------------------------------------------*/
+//
+// The history of user definitions. Each DEFINE, RECORD, METHOD, MACRO
+// and 'define!' adds an entry that knows how to undo itself so 'forget'
+// can remove a word and everything defined after it.
+//
+
+type definition struct {
+	name string
+	undo func()
+}
+
+var definitions []definition
+
+// defineWord binds a user word in ops, remembering what it replaced
+func defineWord(name string, fn interface{}) {
+	prev, existed := ops[name]
+	definitions = append(definitions, definition{name: name, undo: func() {
+		if existed {
+			setWord(name, prev)
+		} else {
+			removeWord(name)
+		}
+	}})
+	setWord(name, fn)
+}
+
+// libraryFile finds a library script that ships with the interpreter. It
+// looks in the current directory first and then next to the executable.
+func libraryFile(name string) string {
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+	if exe, err := os.Executable(); err == nil {
+		if exe, err = filepath.EvalSymlinks(exe); err == nil {
+			path := filepath.Join(filepath.Dir(exe), name)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return name
+}
+
+/*------------------------------------------------------------*/
+//
+// Word cells. Late-bound calls go through a cell holding the word's
+// current definition so redefining a word changes every caller that
+// was compiled before it, and a word can be used before it's defined.
+//
+
+type wordCell struct {
+	name  string
+	value interface{}
+}
+
+var wordCells = make(map[string]*wordCell)
+
+// When true, words are bound when the caller is compiled. This is faster
+// but later redefinitions aren't seen. Set with EARLY-BINDING/LATE-BINDING.
+var earlyBinding bool
+
+// wordCellFor gets the cell for a word, creating it if needed
+func wordCellFor(name string) *wordCell {
+	cell, ok := wordCells[name]
+	if !ok {
+		cell = &wordCell{name: name, value: ops[name]}
+		wordCells[name] = cell
+	}
+	return cell
+}
+
+// setWord changes the definition of a word, updating its cell
+func setWord(name string, fn interface{}) {
+	ops[name] = fn
+	if cell, ok := wordCells[name]; ok {
+		cell.value = fn
+	}
+}
+
+// removeWord deletes a word; late-bound callers will fail when they call it
+func removeWord(name string) {
+	delete(ops, name)
+	if cell, ok := wordCells[name]; ok {
+		cell.value = nil
+	}
+}
+
+// call invokes the current definition of the word in the cell
+func (cell *wordCell) call() {
+	switch fn := cell.value.(type) {
+	case func():
+		fn()
+	case op:
+		fn.fn()
+	case nil:
+		GfError("Undefined function '%s'", cell.name)
+	default:
+		GfError("calling '%s': expected func(), not %t", cell.name, fn)
+	}
+}
+
+/*------------------------------------------------------------*/
+//
+// Constants and strict mode. 'CONST name value' binds a name to a value
+// that can't be changed; uses of the name are replaced by the value when
+// they're compiled. In STRICT mode, reading or writing a variable that
+// hasn't been declared with '->', 'global', CONST or as a function
+// argument or local is a compile error, as is using a bare name that
+// is neither a word nor a declared variable by the end of the file.
+//
+
+var constants = make(map[string]interface{})
+
+// When true, undeclared variables are compile errors. Set with STRICT.
+var strictMode bool
+
+// Bare names used in STRICT mode before they were defined. They're checked
+// when the whole file has been compiled so words can call each other.
+var strictForwardRefs []Token
+
+// compileUnit compiles a whole file or piece of text, checking the forward
+// references made in STRICT mode once all of it has been compiled
+func compileUnit(fields []Token) []op {
+	oldRefs := strictForwardRefs
+	strictForwardRefs = nil
+	defer func() { strictForwardRefs = oldRefs }()
+
+	_, body := Compile(fields, 0, "", nil)
+	if !loop {
+		return body
+	}
+	for _, tok := range strictForwardRefs {
+		if !isDeclared(tok.Name, nil) {
+			activeFunction = op{fn: nil, tok: tok}
+			GfError("'%s' is not a word or a declared variable", tok.Name)
+			return nil
+		}
+	}
+	return body
+}
+
+// constValue computes the value of a constant at compile time. The value is
+// a single token or a list literal [ ... ]; it returns the value and the
+// index of the token after it.
+func constValue(fields []Token, start int, name string) (interface{}, int) {
+	valTok := fields[start]
+	end := start
+	if valTok.Name == "[" && !valTok.IsValue {
+		depth := 0
+		for ; end < len(fields); end++ {
+			if fields[end].IsValue {
+				continue
+			}
+			if fields[end].Name == "[" {
+				depth++
+			} else if fields[end].Name == "]" {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if end >= len(fields) {
+			activeFunction = op{fn: nil, tok: valTok}
+			GfError("missing ']' in the value of constant '%s'", name)
+			return nil, 0
+		}
+	}
+
+	_, code := Compile(fields[start:end+1], 0, "", nil)
+	if !loop {
+		return nil, 0
+	}
+	oldFunc := activeFunction
+	activeFunction = op{fn: nil, tok: valTok}
+	depth := ValueStack.index
+	Eval(code)
+	if loop && ValueStack.index != depth+1 {
+		GfError("the value of constant '%s' must be a single value or a list [ ... ]", name)
+	}
+	if !loop {
+		return nil, 0
+	}
+	activeFunction = oldFunc
+	return ValueStack.Pop("constant"), end + 1
+}
+
+// defineConstant binds a constant and a word that pushes it
+func defineConstant(name string, val interface{}) {
+	prev, existed := ops[name]
+	definitions = append(definitions, definition{name: name, undo: func() {
+		delete(constants, name)
+		if existed {
+			setWord(name, prev)
+		} else {
+			removeWord(name)
+		}
+	}})
+	constants[name] = val
+	setWord(name, func() { ValueStack.Push(val) })
+}
+
+// isLocal checks if a name is one of the variables declared in the code being compiled
+func isLocal(name string, locals []string) bool {
+	for _, v := range locals {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeclared checks if a variable name can be used in STRICT mode
+func isDeclared(name string, locals []string) bool {
+	_, isConst := constants[name]
+	_, isWord := ops[name]
+	return isConst || isWord || isLocal(name, locals)
+}
+
+// forgetFrom undoes the definitions from index to the end of the history
+func forgetFrom(index int) {
+	for i := len(definitions) - 1; i >= index; i-- {
+		definitions[i].undo()
+	}
+	definitions = definitions[:index]
+}
+
+// wordName gets the name of a word from a string or symbol argument
+func wordName(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case *Symbol:
+		return v.Name, true
+	}
+	return "", false
+}
+
+/*------------------------------------------------------------*/
+//
+// Memoisation. 'memo' wraps a word or block so the results for each list
+// of arguments are cached. The caches are Dicts so arguments are matched
+// structurally, the same way Compare does, and the oldest entries are
+// evicted first when a cache reaches the limit set by 'memo:limit'.
+//
+
+// wordArity holds the number of named arguments of DEFINE words
+var wordArity = make(map[string]int)
+
+// memoGeneration is bumped by 'memo:clear'; a cache from an older
+// generation is emptied the next time it's used. Caches aren't kept in a
+// list so they go away with the word or block that owns them.
+var memoGeneration int
+
+// The maximum number of entries in each memo cache; 0 means no limit
+var memoLimit int
+
+// memoCache holds the saved results of a memoised word or block
+type memoCache struct {
+	results    *Dict
+	generation int
+}
+
+// memoize wraps a prog that takes arity arguments so its results are cached
+func memoize(prog func(), arity int, name string) func() {
+	cache := &memoCache{results: NewDict(0), generation: memoGeneration}
+	return func() {
+		if ValueStack.index < arity {
+			GfError("'%s' needs %d arguments on the stack", name, arity)
+			return
+		}
+		cache.refresh()
+		base := ValueStack.index - arity
+		args := make([]interface{}, arity)
+		for i, arg := range ValueStack.Value[base:ValueStack.index] {
+			args[i] = memoKey(arg)
+		}
+		if results, ok := cache.results.Get(args); ok {
+			ValueStack.index = base
+			pushValues(results.([]interface{})...)
+			return
+		}
+
+		prog()
+		if !loop || ValueStack.index < base {
+			// The prog used more than its arguments so it can't be cached
+			return
+		}
+		results := make([]interface{}, ValueStack.index-base)
+		copy(results, ValueStack.Value[base:ValueStack.index])
+		cache.results.Set(args, results)
+		cache.refresh()
+	}
+}
+
+// memoKey makes the cache key for an argument. Dict keys match numbers by
+// value, so 1 and 1.0 would share an entry; pairing values with their type
+// keeps the results the same as running the word.
+func memoKey(arg interface{}) interface{} {
+	if items, ok := listItems(arg); ok {
+		keys := make([]interface{}, len(items))
+		for i, item := range items {
+			keys[i] = memoKey(item)
+		}
+		return []interface{}{typeName(arg), keys}
+	}
+	if numericRank(arg) != rankNone {
+		return []interface{}{typeName(arg), arg}
+	}
+	return arg
+}
+
+// refresh empties the cache if 'memo:clear' has been called since it was
+// last used and evicts the oldest entries until it's within the limit
+func (cache *memoCache) refresh() {
+	if cache.generation != memoGeneration {
+		cache.results = NewDict(0)
+		cache.generation = memoGeneration
+	}
+	for memoLimit > 0 && cache.results.Len() > memoLimit {
+		cache.results.PopOldest()
+	}
+}
+
 /*------------------------------------------------------------*/
 //
 // Compile a list of tokens into an executable 'op' array.
@@ -760,7 +1405,14 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 			var bodyPtr *[]op
 			var defToken = fields[index-1]
 
-			ops[funcName] = func() {
+			if len(argList) > 0 {
+				wordArity[funcName] = len(argList)
+			} else {
+				delete(wordArity, funcName)
+			}
+
+			defIndex := len(definitions)
+			defineWord(funcName, func() {
 				VariableTable = NewScope(VariableTable)
 
 				for i := len(argList) - 1; i >= 0; i-- {
@@ -777,72 +1429,368 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 				Eval(*bodyPtr)
 				CallStack.Pop("funcExit")
 				VariableTable = VariableTable.Parent
-			}
+			})
 
 			index++
 			if index >= len(fields) {
 				activeFunction = op{fn: nil, tok: f}
 				GfError("body for function '%s' is missing", funcName)
-				delete(ops, funcName)
+				forgetFrom(defIndex)
 				return 0, nil
 			}
 
-			parentLocals = []string{}
+			funcLocals := []string{}
 			for _, v := range argList {
-				parentLocals = append(parentLocals, v)
+				funcLocals = append(funcLocals, v)
 			}
 			for _, v := range locals {
-				parentLocals = append(parentLocals, v)
+				funcLocals = append(funcLocals, v)
+			}
+			offset, body := Compile(fields, index, ";", funcLocals)
+			if !loop {
+				// Stop here rather than carrying on from a bogus offset
+				forgetFrom(defIndex)
+				return 0, nil
 			}
-			offset, body := Compile(fields, index, ";", parentLocals)
 			bodyPtr = &body
 
 			index = offset
 			continue
 		}
 
-		if f.Name == "{" {
-			offset, body := Compile(fields, index+1, "}", parentLocals)
-			bodyPtr := &body
-			wrapper := op{fn: func() { Eval(*bodyPtr) }, tok: f}
-			result = append(result, op{fn: func() { ValueStack.Push(wrapper) }, tok: f})
-			index = offset
+		if f.Name == "CONST" {
+			// Defining a constant: CONST <name> <value>
+			if index+2 >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid constant definition; syntax is: CONST <name> <value>")
+				return 0, nil
+			}
+			constName := fields[index+1].Name
+			if _, exists := constants[constName]; exists {
+				activeFunction = op{fn: nil, tok: fields[index+1]}
+				GfError("constant '%s' is already defined", constName)
+				return 0, nil
+			}
+			valTok := fields[index+2]
+			if valTok.Name == "{" && !valTok.IsValue {
+				activeFunction = op{fn: nil, tok: valTok}
+				GfError("the value of constant '%s' must be a single value, not a block", constName)
+				return 0, nil
+			}
+			val, next := constValue(fields, index+2, constName)
+			if !loop {
+				return 0, nil
+			}
+			defineConstant(constName, val)
+			index = next
 			continue
 		}
 
-		if f.Name == term {
-			return index + 1, result
-		}
+		if f.Name == "FORTH" && !forthMode {
+			// The rest of the file is Forth code
+			if !forthLoaded {
+				forthLoaded = true
+				LoadFile(libraryFile("forth.gf"))
+				if !loop {
+					return 0, nil
+				}
+			}
+			forthMode = true
+			index++
+			continue
+		}
+
+		if f.Name == "STRICT" {
+			// Undeclared variables are errors in the rest of the file
+			strictMode = true
+			index++
+			continue
+		}
+
+		if f.Name == "EARLY-BINDING" || f.Name == "LATE-BINDING" {
+			// Switch how the rest of the file binds calls to words
+			earlyBinding = f.Name == "EARLY-BINDING"
+			index++
+			continue
+		}
+
+		if f.Name == "MACRO" {
+			// Defining a macro: MACRO <name> == <body> ;
+			index++
+			if index+1 >= len(fields) || fields[index+1].Name != "==" {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid macro definition; syntax is: MACRO <name> == ... ;")
+				return 0, nil
+			}
+			macroName := fields[index].Name
+			offset, body := Compile(fields, index+2, ";", nil)
+			if !loop {
+				return 0, nil
+			}
+			prevMacro, existed := macros[macroName]
+			definitions = append(definitions, definition{name: macroName, undo: func() {
+				if existed {
+					macros[macroName] = prevMacro
+				} else {
+					delete(macros, macroName)
+				}
+			}})
+			macros[macroName] = func() { Eval(body) }
+			index = offset
+			continue
+		}
+
+		if macro, ok := macros[f.Name]; ok && !f.IsValue {
+			// Expand the macro into the code being compiled
+			ctx := &compileContext{fields: fields, index: index + 1, result: &result, locals: parentLocals}
+			compileContexts = append(compileContexts, ctx)
+			oldFunc := activeFunction
+			activeFunction = op{fn: nil, tok: f}
+			CallStack.Push(f)
+			macro()
+			CallStack.Pop("exitMacro")
+			activeFunction = oldFunc
+			compileContexts = compileContexts[:len(compileContexts)-1]
+			if !loop {
+				return 0, nil
+			}
+			index = ctx.index
+			continue
+		}
+
+		if f.Name == "METHOD" {
+			// Defining a method: METHOD <name> <type> ... == <body> ;
+			index++
+			if index >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("missing method name after 'METHOD', syntax is: METHOD <name> <type> ... == ... ;")
+				return 0, nil
+			}
+			methodName := fields[index].Name
+			index++
+			var types []string
+			for index < len(fields) && fields[index].Name != "==" {
+				if !isTypeName(fields[index].Name) {
+					activeFunction = op{fn: nil, tok: fields[index]}
+					GfError("unknown type '%s' in method '%s'", fields[index].Name, methodName)
+					return 0, nil
+				}
+				types = append(types, fields[index].Name)
+				index++
+			}
+			if index >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("missing '==' in method definition; syntax is: METHOD <name> <type> ... == ... ;")
+				return 0, nil
+			}
+			if len(types) == 0 {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("method '%s' must name at least one type to dispatch on", methodName)
+				return 0, nil
+			}
+
+			var bodyPtr *[]op
+			defToken := f
+			defIndex := len(definitions)
+			addMethod(methodName, types, func() {
+				CallStack.Push(defToken)
+				Eval(*bodyPtr)
+				CallStack.Pop("funcExit")
+			})
+
+			offset, body := Compile(fields, index+1, ";", nil)
+			if !loop {
+				forgetFrom(defIndex)
+				return 0, nil
+			}
+			bodyPtr = &body
+			index = offset
+			continue
+		}
+
+		if f.Name == "RECORD" {
+			// Defining a record type: RECORD <name> <field> ... ;
+			index++
+			if index >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("missing record name after 'RECORD', syntax is: RECORD <name> <field> ... ;")
+				return 0, nil
+			}
+			recordName := fields[index].Name
+			index++
+			var recordFields []string
+			for index < len(fields) && fields[index].Name != ";" {
+				recordFields = append(recordFields, fields[index].Name)
+				index++
+			}
+			if index >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("missing ';' at the end of record '%s'", recordName)
+				return 0, nil
+			}
+			activeFunction = op{fn: nil, tok: f}
+			defineRecord(recordName, recordFields)
+			index++
+			continue
+		}
+
+		if f.IsValue {
+			val := f.Value
+			result = append(result, op{fn: func() { ValueStack.Push(val) }, tok: f})
+			index++
+			continue
+		}
+
+		if f.Name == "{" {
+			offset, body := Compile(fields, index+1, "}", parentLocals)
+			if !loop {
+				return 0, nil
+			}
+			bodyPtr := &body
+			wrapper := op{fn: func() { Eval(*bodyPtr) }, tok: f}
+			if offset > index+1 && offset <= len(fields) {
+				wrapper.code = fields[index+1 : offset-1]
+			}
+			result = append(result, op{fn: func() { ValueStack.Push(wrapper) }, tok: f})
+			index = offset
+			continue
+		}
+
+		if f.Name == term {
+			return index + 1, result
+		}
+
+		if forthMode && !f.IsValue {
+			if forthTerm(f.Name, term) {
+				return index + 1, result
+			}
+			next, handled, done := compileForth(fields, index, &result)
+			if !loop {
+				return 0, nil
+			}
+			if done {
+				return next, result
+			}
+			if handled {
+				index = next
+				continue
+			}
+		}
 
 		isFloat, _ := regexp.MatchString("^-?[0-9]+\\.[0-9]+(e-?[0-9]+)?$", f.Name)
-		isNumber, _ := regexp.MatchString("^-?[0-9,_]+$", f.Name)
+		isRat, _ := regexp.MatchString("^-?[0-9]+/[0-9]+$", f.Name)
+		isDecimal, _ := regexp.MatchString("^-?[0-9]+(\\.[0-9]+)?d$", f.Name)
+		isComplex, _ := regexp.MatchString("^-?([0-9]+(\\.[0-9]+)?[+-])?[0-9]+(\\.[0-9]+)?i$", f.Name)
+		isNumber, _ := regexp.MatchString("^-?[0-9][0-9,_]*$", f.Name)
+		isDuration, _ := regexp.MatchString("^-?([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$", f.Name)
 		isString := f.Name[0] == '"'
+		isDotQuote := strings.HasPrefix(f.Name, ".\"")
+		isForthString := strings.HasPrefix(f.Name, "S\"")
+		isBytes := strings.HasPrefix(f.Name, "b\"")
+		isHexBytes := strings.HasPrefix(f.Name, "x\"")
 		isVarSet, _ := regexp.MatchString("^\\![^ =][^ ]*$", f.Name)
 		isVarGet, _ := regexp.MatchString("^[@$][^ ]+$", f.Name)
 		isFuncCall, _ := regexp.MatchString("^\\&[^ ]+$", f.Name)
 		isRegex := len(f.Name) > 1 && f.Name[0] == 'r' && f.Name[1] == '/'
 		isChar := f.Name[0] == '\''
+		isSymbol := len(f.Name) > 1 && f.Name[0] == ':'
 		if isFloat {
 			num, _ := strconv.ParseFloat(f.Name, 64)
 			result = append(result, op{fn: func() { ValueStack.Push(num) }, tok: f})
+		} else if isRat {
+			num, ok := new(big.Rat).SetString(f.Name)
+			if !ok {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid rational literal '%s'", f.Name)
+			} else {
+				val := normalizeRat(num)
+				result = append(result, op{fn: func() { ValueStack.Push(val) }, tok: f})
+			}
+		} else if isComplex {
+			num, err := strconv.ParseComplex(f.Name, 128)
+			if err != nil {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid complex literal '%s': %s", f.Name, err)
+			} else {
+				result = append(result, op{fn: func() { ValueStack.Push(num) }, tok: f})
+			}
+		} else if isDuration {
+			dur, err := time.ParseDuration(f.Name)
+			if err != nil {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid duration literal '%s': %s", f.Name, err)
+			} else {
+				result = append(result, op{fn: func() { ValueStack.Push(dur) }, tok: f})
+			}
+		} else if isDecimal {
+			num, _ := parseDecimal(strings.TrimSuffix(f.Name, "d"))
+			result = append(result, op{fn: func() { ValueStack.Push(num) }, tok: f})
 		} else if isNumber {
 			sval := strings.ReplaceAll(f.Name, ",", "")
 			sval = strings.ReplaceAll(sval, "_", "")
-			num, _ := strconv.Atoi(sval)
-			result = append(result, op{fn: func() {
-				ValueStack.Value[ValueStack.index] = num
-				ValueStack.index++
-			}, tok: f})
+			num, ok := parseInteger(sval)
+			if !ok {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid integer literal '%s'", f.Name)
+			} else if _, isBig := num.(*big.Int); isBig {
+				result = append(result, op{fn: func() { ValueStack.Push(num) }, tok: f})
+			} else {
+				result = append(result, op{fn: func() {
+					ValueStack.Value[ValueStack.index] = num
+					ValueStack.index++
+				}, tok: f})
+			}
 		} else if isString {
 			str := strings.Trim(f.Name, "\"")
 			result = append(result, op{fn: func() { ValueStack.Push(str) }, tok: f})
+		} else if isDotQuote {
+			// Forth-style ." text" prints the text
+			str := strings.TrimPrefix(strings.TrimSuffix(f.Name[2:], "\""), " ")
+			result = append(result, op{fn: func() { fmt.Print(str) }, tok: f})
+		} else if isForthString {
+			str := strings.TrimPrefix(strings.TrimSuffix(f.Name[2:], "\""), " ")
+			result = append(result, op{fn: func() { ValueStack.Push(str) }, tok: f})
+		} else if isSymbol {
+			sym := Intern(f.Name[1:])
+			result = append(result, op{fn: func() { ValueStack.Push(sym) }, tok: f})
+		} else if isBytes {
+			data := parseBytesLiteral(f.Name[2 : len(f.Name)-1])
+			result = append(result, op{fn: func() { ValueStack.Push(data) }, tok: f})
+		} else if isHexBytes {
+			data, err := hex.DecodeString(strings.Join(strings.Fields(f.Name[2:len(f.Name)-1]), ""))
+			if err != nil {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("invalid hex byte string literal %s: %s", f.Name, err)
+			} else {
+				result = append(result, op{fn: func() { ValueStack.Push(Bytes(data)) }, tok: f})
+			}
 		} else if isVarSet {
 			str := string(f.Name[1:])
+			if _, isConst := constants[str]; isConst {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("can't assign to constant '%s'", str)
+				return 0, nil
+			}
+			if strictMode && !isDeclared(str, parentLocals) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("variable '%s' has not been declared", str)
+				return 0, nil
+			}
 			result = append(result, op{fn: (func() {
 				VariableTable.Set(str, ValueStack.Pop("valueToStore"))
 			}), tok: f})
 		} else if isVarGet {
 			str := string(f.Name[1:])
+			if strictMode && !isDeclared(str, parentLocals) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("variable '%s' has not been declared", str)
+				return 0, nil
+			}
+			if val, isConst := constants[str]; isConst && !isLocal(str, parentLocals) {
+				result = append(result, op{fn: func() { ValueStack.Push(val) }, tok: f})
+				index++
+				continue
+			}
 			result = append(result, op{fn: (func() {
 				val, in := VariableTable.Get(str)
 				if !in {
@@ -875,7 +1823,7 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 				}, tok: f})
 			}
 		} else if isChar {
-			charToPush := rune(f.Name[1])
+			charToPush, _ := utf8.DecodeRuneInString(f.Name[1:])
 			result = append(result, op{fn: func() {
 				ValueStack.Push(charToPush)
 			}, tok: f})
@@ -892,6 +1840,11 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 				return 0, nil
 			}
 			varName := fields[index].Name
+			if _, isConst := constants[varName]; isConst {
+				activeFunction = op{fn: nil, tok: fields[index]}
+				GfError("can't assign to constant '%s'", varName)
+				return 0, nil
+			}
 			parentLocals = append(parentLocals, varName)
 			result = append(result, op{fn: func() {
 				val := ValueStack.Pop("valueToStore")
@@ -900,6 +1853,23 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 				}
 				VariableTable.Set(varName, val)
 			}, tok: f})
+		} else if f.Name == "global" {
+			index++
+			if index >= len(fields) {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("missing variable name after 'global', syntax is: global foo")
+				return 0, nil
+			}
+			varName := fields[index].Name
+			if _, isConst := constants[varName]; isConst {
+				activeFunction = op{fn: nil, tok: fields[index]}
+				GfError("can't declare constant '%s' as a global variable", varName)
+				return 0, nil
+			}
+			parentLocals = append(parentLocals, varName)
+			result = append(result, op{fn: func() {
+				VariableTable.DeclareGlobal(varName)
+			}, tok: f})
 		} else if f.Name == "IMPORT" {
 			index++
 			if index >= len(fields) {
@@ -937,6 +1907,15 @@ func Compile(fields []Token, start int, term string, parentLocals []string) (int
 						ValueStack.Push(val)
 					}
 				}), tok: f})
+			} else if val, isConst := constants[f.Name]; isConst {
+				result = append(result, op{fn: func() { ValueStack.Push(val) }, tok: f})
+			} else if !earlyBinding {
+				if strictMode && !isDeclared(f.Name, parentLocals) {
+					// It may be a word defined later in the file
+					strictForwardRefs = append(strictForwardRefs, f)
+				}
+				cell := wordCellFor(f.Name)
+				result = append(result, op{fn: cell.call, tok: f})
 			} else {
 				fn, exists := ops[f.Name]
 				if !exists {
@@ -978,6 +1957,14 @@ func Compare(v1 interface{}, v2 interface{}) int {
 	}
 
 	switch targetType := v2.(type) {
+	case *RecordType:
+		if r, ok := v1.(*Record); ok && r.Type == targetType {
+			return 0
+		}
+		if v1 == v2 {
+			return 0
+		}
+		return 1
 	case reflect.Type:
 		switch valueType := v1.(type) {
 		case reflect.Type:
@@ -993,6 +1980,24 @@ func Compare(v1 interface{}, v2 interface{}) int {
 		}
 	}
 
+	if numericRank(v1) != rankNone && numericRank(v2) != rankNone &&
+		(isExtendedNumber(v1) || isExtendedNumber(v2)) {
+		return compareNumbers(v1, v2)
+	}
+
+	if items, ok := persistentItems(v1); ok {
+		v1 = items
+	}
+	if items, ok := persistentItems(v2); ok {
+		v2 = items
+	}
+
+	if _, ok := v2.(*Symbol); ok {
+		if _, ok := v1.(*Symbol); !ok {
+			return -Compare(v2, v1)
+		}
+	}
+
 	switch x := v1.(type) {
 	case float64:
 		switch y := v2.(type) {
@@ -1081,6 +2086,74 @@ func Compare(v1 interface{}, v2 interface{}) int {
 				return 0
 			}
 		}
+	case Bytes:
+		switch y := v2.(type) {
+		case Bytes:
+			return bytes.Compare(x, y)
+		}
+	case *Record:
+		switch y := v2.(type) {
+		case *Record:
+			if x.Type != y.Type {
+				return strings.Compare(x.Type.Name, y.Type.Name)
+			}
+			return Compare(x.Values, y.Values)
+		}
+	case *Symbol:
+		switch y := v2.(type) {
+		case *Symbol:
+			if x == y {
+				return 0
+			}
+			return strings.Compare(x.Name, y.Name)
+		default:
+			// A symbol is never equal to a value of another type
+			if c := Compare(x.String(), fmt.Sprint(y)); c != 0 {
+				return c
+			}
+			return -1
+		}
+	case time.Time:
+		switch y := v2.(type) {
+		case time.Time:
+			if x.Before(y) {
+				return -1
+			} else if x.After(y) {
+				return 1
+			}
+			return 0
+		}
+	case time.Duration:
+		switch y := v2.(type) {
+		case time.Duration:
+			if x < y {
+				return -1
+			} else if x > y {
+				return 1
+			}
+			return 0
+		}
+	case bool:
+		switch y := v2.(type) {
+		case bool:
+			if x == y {
+				return 0
+			} else if y {
+				return -1
+			}
+			return 1
+		}
+	case *Dict:
+		switch y := v2.(type) {
+		case *Dict:
+			if keysEqual(x, y) {
+				return 0
+			}
+			if x.Len() != y.Len() {
+				return Compare(x.Len(), y.Len())
+			}
+			return Compare(x.String(), y.String())
+		}
 	case []interface{}:
 		switch y := v2.(type) {
 		case []interface{}:
@@ -1125,10 +2198,28 @@ func isTrue(val interface{}) bool {
 		return v != 0
 	case float64:
 		return v != 0
+	case *big.Int:
+		return v.Sign() != 0
+	case *big.Rat:
+		return v.Sign() != 0
+	case Decimal:
+		return v.Unscaled.Sign() != 0
+	case complex128:
+		return v != 0
 	case []interface{}:
 		return len(v) != 0
-	case map[interface{}]interface{}:
+	case *Dict:
+		return v.Len() != 0
+	case *PVector:
+		return v.Len() != 0
+	case BitSet:
+		return v != 0
+	case *PList:
+		return v.Len() != 0
+	case Bytes:
 		return len(v) != 0
+	case *Symbol:
+		return true
 	case map[string]interface{}:
 		return len(v) != 0
 	case string:
@@ -1151,6 +2242,10 @@ func stringify(val interface{}) string {
 		return fmt.Sprintf("%f", val)
 	case string:
 		return val
+	case *big.Int:
+		return val.String()
+	case *big.Rat:
+		return val.RatString()
 	default:
 		return fmt.Sprintf("%v", val)
 	}
@@ -1158,1176 +2253,4917 @@ func stringify(val interface{}) string {
 
 var listType = reflect.TypeOf(make([]interface{}, 0))
 
-func binRecHelper(val interface{}, ifProg, thenProg, recProg, endProg func()) {
-	ValueStack.Push(val)
-	ifProg()
-	r := ValueStack.Pop("ifProgResult")
-	if !loop {
-		return
-	}
-	if isTrue(r) {
-		ValueStack.Push(val)
-		thenProg()
-		return
-	}
-	ValueStack.Push(val)
-	recProg()
-	val1 := ValueStack.Pop("rec1Val")
-	val2 := ValueStack.Pop("rec2val")
-	binRecHelper(val1, ifProg, thenProg, recProg, endProg)
-	val1 = ValueStack.Pop("rec1Result")
-	if !loop {
-		return
-	}
-	binRecHelper(val2, ifProg, thenProg, recProg, endProg)
-	val2 = ValueStack.Pop("rec2Result")
-	if !loop {
-		return
-	}
-	ValueStack.Push(val1)
-	ValueStack.Push(val2)
+/*------------------------------------------------------------*/
+//
+// Persistent (immutable) vectors and lists. Updating one of these values
+// returns a new value that shares most of its structure with the original
+// so values can be passed around freely without aliasing surprises.
+//
 
-	endProg()
+const pvBits = 5
+const pvWidth = 1 << pvBits
+const pvMask = pvWidth - 1
+
+type pvNode struct {
+	array []interface{}
 }
 
-func main() {
+// PVector is a persistent vector implemented as a 32-way trie with a tail
+// buffer. Indexing and update are O(log32 n), appending is amortised O(1)
+// and dropping elements from the front is O(1).
+type PVector struct {
+	start int
+	count int
+	shift uint
+	root  *pvNode
+	tail  []interface{}
+}
 
-	//C Causes subsequent functions to be stepped i.e. run one a time with the
-	//C current state of the stack displayed.
-	ops["step"] = func() {
-		step = true
+var emptyPVector = &PVector{shift: pvBits, root: &pvNode{}}
+
+// NewPVector creates a persistent vector holding the elements of a list
+func NewPVector(items []interface{}) *PVector {
+	result := emptyPVector
+	for _, v := range items {
+		result = result.Conj(v)
 	}
+	return result
+}
 
-	ops["compare"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2))
+// Len returns the number of elements in the vector
+func (v *PVector) Len() int {
+	return v.count - v.start
+}
+
+func (v *PVector) tailOffset() int {
+	if v.count < pvWidth {
+		return 0
 	}
+	return ((v.count - 1) >> pvBits) << pvBits
+}
 
-	//C Polymorphic function that compares two values of any type for equality.
-	ops["=="] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) == 0)
+// Nth returns the element at index i which must be in range
+func (v *PVector) Nth(i int) interface{} {
+	i += v.start
+	if i >= v.tailOffset() {
+		return v.tail[i&pvMask]
 	}
+	node := v.root
+	for level := v.shift; level > 0; level -= pvBits {
+		node = node.array[(i>>level)&pvMask].(*pvNode)
+	}
+	return node.array[i&pvMask]
+}
 
-	//C Polymorphic function that compares two values of any type for inequality.
-	ops["!="] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) != 0)
+// Conj returns a new vector with val added to the end
+func (v *PVector) Conj(val interface{}) *PVector {
+	if v.count-v.tailOffset() < pvWidth {
+		tail := make([]interface{}, len(v.tail)+1)
+		copy(tail, v.tail)
+		tail[len(v.tail)] = val
+		return &PVector{start: v.start, count: v.count + 1, shift: v.shift, root: v.root, tail: tail}
+	}
+
+	// The tail is full so push it into the tree
+	tailNode := &pvNode{array: v.tail}
+	shift := v.shift
+	var root *pvNode
+	if (v.count >> pvBits) > (1 << v.shift) {
+		root = &pvNode{array: []interface{}{v.root, newPVPath(v.shift, tailNode)}}
+		shift += pvBits
+	} else {
+		root = v.pushTail(v.shift, v.root, tailNode)
 	}
+	return &PVector{start: v.start, count: v.count + 1, shift: shift, root: root, tail: []interface{}{val}}
+}
 
-	//C Returns true if the first value is less than the second.
-	ops[">"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) > 0)
+func (v *PVector) pushTail(level uint, parent *pvNode, tailNode *pvNode) *pvNode {
+	subidx := ((v.count - 1) >> level) & pvMask
+	result := &pvNode{array: make([]interface{}, len(parent.array))}
+	copy(result.array, parent.array)
+	var insert *pvNode
+	if level == pvBits {
+		insert = tailNode
+	} else if subidx < len(parent.array) {
+		insert = v.pushTail(level-pvBits, parent.array[subidx].(*pvNode), tailNode)
+	} else {
+		insert = newPVPath(level-pvBits, tailNode)
+	}
+	if subidx < len(result.array) {
+		result.array[subidx] = insert
+	} else {
+		result.array = append(result.array, insert)
 	}
+	return result
+}
 
-	//C Returns true if the first value is greater than or equal to the second.
-	ops[">="] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) >= 0)
+func newPVPath(level uint, node *pvNode) *pvNode {
+	if level == 0 {
+		return node
 	}
+	return &pvNode{array: []interface{}{newPVPath(level-pvBits, node)}}
+}
 
-	//C Returns true if the first value is greater than the second.
-	ops["<"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) < 0)
+// Assoc returns a new vector with the element at index i replaced by val.
+// If i is equal to the length of the vector, val is appended.
+func (v *PVector) Assoc(i int, val interface{}) *PVector {
+	if i == v.Len() {
+		return v.Conj(val)
 	}
+	i += v.start
+	if i >= v.tailOffset() {
+		tail := make([]interface{}, len(v.tail))
+		copy(tail, v.tail)
+		tail[i&pvMask] = val
+		return &PVector{start: v.start, count: v.count, shift: v.shift, root: v.root, tail: tail}
+	}
+	return &PVector{start: v.start, count: v.count, shift: v.shift, root: assocPV(v.shift, v.root, i, val), tail: v.tail}
+}
 
-	//C Returns true if the first value is less than or equal to the second.
-	ops["<="] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(Compare(v1, v2) <= 0)
+func assocPV(level uint, node *pvNode, i int, val interface{}) *pvNode {
+	result := &pvNode{array: make([]interface{}, len(node.array))}
+	copy(result.array, node.array)
+	if level == 0 {
+		result.array[i&pvMask] = val
+	} else {
+		subidx := (i >> level) & pvMask
+		result.array[subidx] = assocPV(level-pvBits, node.array[subidx].(*pvNode), i, val)
 	}
+	return result
+}
 
-	//C true false and -> false
-	//C true true and -> true
-	//C Logical 'and' of two values.
-	ops["and"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(isTrue(v1) && isTrue(v2))
+// Drop returns a new vector without the first n elements
+func (v *PVector) Drop(n int) *PVector {
+	if n <= 0 {
+		return v
 	}
+	if n >= v.Len() {
+		return emptyPVector
+	}
+	result := *v
+	result.start += n
+	return &result
+}
 
-	//C true false or -> true
-	//C false false or -> false
-	//C Logical 'or' of two values.
-	ops["or"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(isTrue(v1) || isTrue(v2))
+// Items returns the elements of the vector as a new list
+func (v *PVector) Items() []interface{} {
+	result := make([]interface{}, v.Len())
+	for i := range result {
+		result[i] = v.Nth(i)
 	}
+	return result
+}
 
-	//C Returns the keys in a dictionary as a list.
-	ops["keys"] = func() {
-		val := ValueStack.Pop("dictionary")
-		if !loop {
-			return
-		}
-		switch val := val.(type) {
-		case map[interface{}]interface{}:
-			keys := make([]interface{}, 0, len(ops))
-			for k := range val {
-				keys = append(keys, k)
-			}
-			ValueStack.Push(keys)
-		case map[string]interface{}:
-			keys := make([]interface{}, 0, len(ops))
-			for k := range val {
-				keys = append(keys, k)
-			}
-			ValueStack.Push(keys)
-		default:
-			GfError("The 'keys' function can only be used on a map, not %v", reflect.TypeOf(val))
-		}
+func (v *PVector) String() string {
+	return "#" + fmt.Sprint(v.Items())
+}
+
+var vectorType = reflect.TypeOf(emptyPVector)
+
+// PList is a persistent singly linked list. 'cons', 'uncons', 'first'
+// and 'rest' are all O(1). The empty list has a nil tail.
+type PList struct {
+	head  interface{}
+	tail  *PList
+	count int
+}
+
+var emptyPList = &PList{}
+
+// NewPList creates a persistent list holding the elements of a list
+func NewPList(items []interface{}) *PList {
+	result := emptyPList
+	for i := len(items) - 1; i >= 0; i-- {
+		result = result.Cons(items[i])
 	}
+	return result
+}
 
-	//C Prints out the list of available functions.
-	ops["help"] = func() {
-		count := 0
+// Cons returns a new list with val at the front
+func (l *PList) Cons(val interface{}) *PList {
+	return &PList{head: val, tail: l, count: l.count + 1}
+}
 
-		for k := range ops {
-			fmt.Printf("%15s", k)
-			if count == 6 {
-				fmt.Println()
-				count = 0
-				continue
-			}
-			count++
-		}
-		fmt.Println()
+// Len returns the number of elements in the list
+func (l *PList) Len() int {
+	return l.count
+}
+
+// First returns the first element of the list or nil if it is empty
+func (l *PList) First() interface{} {
+	return l.head
+}
+
+// Rest returns the list without its first element
+func (l *PList) Rest() *PList {
+	if l.tail == nil {
+		return emptyPList
 	}
+	return l.tail
+}
 
-	//C 5 {@_} repeat -> 1 2 3 4 5
-	//C Repeats a prog <N> times. The value of N is available in the block as @_.
-	//C The results of each execution of the prog (if any) are pushed onto the stack.
-	ops["repeat"] = func() {
-		val := ValueStack.Pop("program")
-		if !loop {
-			return
-		}
-		var body func()
-		switch val := val.(type) {
-		case op:
-			body = val.fn
-		case func():
-			body = val
-		default:
-			GfError("The second argument to 'repeat' must be a lambda, to %t", val)
-			return
-		}
+// Drop returns the list without its first n elements
+func (l *PList) Drop(n int) *PList {
+	for ; n > 0 && l.count > 0; n-- {
+		l = l.tail
+	}
+	return l
+}
 
-		iterval := ValueStack.Pop("itercount")
-		var itercount int
-		switch iterval := iterval.(type) {
-		case int:
-			itercount = iterval
-		case float64:
-			itercount = int(iterval)
-		default:
-			GfError("The first argument to 'repeat' must be an integer.")
-			return
-		}
+// Items returns the elements of the list as a new list
+func (l *PList) Items() []interface{} {
+	result := make([]interface{}, 0, l.count)
+	for ; l.count > 0; l = l.tail {
+		result = append(result, l.head)
+	}
+	return result
+}
 
-		oldval, ok := VariableTable.Get("_")
-		for i := 0; i < itercount; i++ {
-			if !loop {
-				break
-			}
-			VariableTable.Set("_", i) // BUGBUGBUG - do we really want to do this?
-			body()
-		}
-		if ok {
-			VariableTable.Set("_", oldval)
-		}
+// Assoc returns a new list with the element at index i replaced by val.
+// The part of the list after index i is shared with the original.
+func (l *PList) Assoc(i int, val interface{}) *PList {
+	if i <= 0 || l.count == 0 {
+		return l.Rest().Cons(val)
 	}
+	return l.Rest().Assoc(i-1, val).Cons(l.head)
+}
 
-	//C <val> {<prog1>} {<prog2>} ifte -> <resultOfProg>
-	//C The 'ifte' function (if-then-else) takes a value and two progs.
-	//C If the value is true, then the first prog is executed. If it's
-	//C false, then the second prog is executed.
-	ops["if"] = func() {
-		val := ValueStack.Pop("condVal")
-		if !loop {
-			return
-		}
-		var body func()
-		switch val := val.(type) {
-		case op:
-			body = val.fn
-		case func():
-			body = val
-		default:
-			GfError("The first argument to 'repeat' must be a lambda, to %t", val)
-		}
+func (l *PList) String() string {
+	s := fmt.Sprint(l.Items())
+	return "(" + s[1:len(s)-1] + ")"
+}
 
-		cond := ValueStack.Pop("thenPart")
-		if !loop {
-			return
-		}
+var plistType = reflect.TypeOf(emptyPList)
 
-		if isTrue(cond) {
-			body()
+/*------------------------------------------------------------*/
+//
+// Sets of small integers, like Joy's sets. A BitSet holds members from 0
+// to 63 and prints as #{1 2 3}. Sets work with the list words, with 'and',
+// 'or' and 'xor' for intersection, union and symmetric difference and with
+// 'has' and 'in' for membership.
+//
+
+type BitSet uint64
+
+const bitSetSize = 64
+
+// NewBitSet builds a set from a list of small integers
+func NewBitSet(items []interface{}) (BitSet, bool) {
+	var s BitSet
+	for _, item := range items {
+		n, ok := item.(int)
+		if !ok || n < 0 || n >= bitSetSize {
+			return 0, false
 		}
+		s |= 1 << uint(n)
 	}
+	return s, true
+}
 
-	//C <val> {<prog>} if -> <resultOfProg>
-	//C The 'if' function takes a value and a prog. If the value is true,
-	//C then the first prog is executed. If it's false, then the second \
-	//C prog is executed.
-	ops["ifte"] = func() {
-		elsePartVal := ValueStack.Pop("elsePart")
-		ifPartVal := ValueStack.Pop("thenPart")
-		cond := ValueStack.Pop("condVal")
-		if !loop {
-			return
-		}
+func (s BitSet) Has(n int) bool {
+	return n >= 0 && n < bitSetSize && s&(1<<uint(n)) != 0
+}
 
-		var elsePart func()
-		switch val := elsePartVal.(type) {
-		case op:
-			elsePart = val.fn
-		case func():
-			elsePart = val
-		default:
-			GfError("The 'if' 'else' argument must be a lambda, to %t", val)
-		}
+func (s BitSet) Len() int {
+	return bits.OnesCount64(uint64(s))
+}
 
-		var ifPart func()
-		switch val := ifPartVal.(type) {
-		case op:
-			ifPart = val.fn
-		case func():
-			ifPart = val
-		default:
-			GfError("The 'if' 'then' argument must be a lambda, to %t", val)
+// Items returns the members of the set in ascending order
+func (s BitSet) Items() []interface{} {
+	result := make([]interface{}, 0, s.Len())
+	for n := 0; n < bitSetSize; n++ {
+		if s.Has(n) {
+			result = append(result, n)
 		}
+	}
+	return result
+}
 
-		if isTrue(cond) {
-			ifPart()
-		} else {
-			elsePart()
-		}
+// First returns the smallest member of the set or nil if it's empty
+func (s BitSet) First() interface{} {
+	if s == 0 {
+		return nil
 	}
+	return bits.TrailingZeros64(uint64(s))
+}
 
-	//C <val> [<pat1> <action1> <pat2> <action2> ...] case
-	//C The case function takes a list of pattern/action pairs.
-	//C Patterns can be progs, regular expressoins or literals. If
-	//C a pattern matches, then the corresponding prog is executed
-	//C which may or may not leave a value on the stack.
-	//C Example:  2 [1 "one" 2 "two" 3 "three"] case -> "two"
-	ops["case"] = func() {
-		pattern := ValueStack.Pop("pattern")
-		val := ValueStack.Pop("valToMatch")
-		if !loop {
-			return
-		}
-
-		switch pattern := pattern.(type) {
-		case []interface{}:
-			isPat := true
-			var pe interface{}
-			for _, v := range pattern {
-				if isPat {
-					pe = v
-				} else {
-					switch pe := pe.(type) {
-					case op:
-						ValueStack.Push(val)
-						pe.fn()
-						testResult := ValueStack.Pop("testResult")
-						if !loop {
-							return
-						}
-						if isTrue(testResult) {
-							switch v := v.(type) {
-							case op:
-								ValueStack.Push(val)
-								v.fn()
-							case func():
-								ValueStack.Push(val)
-								v()
-							default:
-								ValueStack.Push(v)
-							}
-							return
-						}
+// Rest returns the set without its smallest member
+func (s BitSet) Rest() BitSet {
+	return s & (s - 1)
+}
 
-					case func():
-						ValueStack.Push(val)
-						pe()
-						testResult := ValueStack.Pop("testResult")
-						if !loop {
-							return
-						}
-						if isTrue(testResult) {
-							switch v := v.(type) {
-							case op:
-								ValueStack.Push(val)
-								v.fn()
-							case func():
-								ValueStack.Push(val)
-								v()
-							default:
-								ValueStack.Push(v)
-							}
-							return
-						}
-					case *regexp.Regexp:
-						if pe.MatchString(fmt.Sprintf("%v", val)) {
-							switch v := v.(type) {
-							case op:
-								ValueStack.Push(val)
-								v.fn()
-							case func():
-								ValueStack.Push(val)
-								v()
-							default:
-								ValueStack.Push(v)
-							}
-							return
-						}
-					case reflect.Type:
-						if pe == reflect.TypeOf(val) {
-							switch v := v.(type) {
-							case op:
-								ValueStack.Push(val)
-								v.fn()
-							case func():
-								ValueStack.Push(val)
-								v()
-							default:
-								ValueStack.Push(v)
-							}
-							return
-						}
-					default:
-						if Compare(pe, val) == 0 {
-							switch v := v.(type) {
-							case op:
-								ValueStack.Push(val)
-								v.fn()
-							case func():
-								ValueStack.Push(val)
-								v()
-							default:
-								ValueStack.Push(v)
-							}
-							return
-						}
-					}
-				}
-				isPat = !isPat
-			}
-		default:
-			GfError("The second argument to 'case' must be a list")
-		}
-	}
+func (s BitSet) String() string {
+	str := fmt.Sprint(s.Items())
+	return "#{" + str[1:len(str)-1] + "}"
+}
 
-	//C Pushes 'true' on the stack
-	ops["true"] = func() { ValueStack.Push(true) }
+var bitSetType = reflect.TypeOf(BitSet(0))
 
-	//C Replaces the top-of-stack with 'true'
-	ops["true!"] = func() { ValueStack.Value[ValueStack.index-1] = true }
+// persistentItems returns the elements of a persistent vector or list, or
+// of a set, as a slice. The second result is false for any other kind of value.
+func persistentItems(val interface{}) ([]interface{}, bool) {
+	switch val := val.(type) {
+	case *PVector:
+		return val.Items(), true
+	case *PList:
+		return val.Items(), true
+	case BitSet:
+		return val.Items(), true
+	}
+	return nil, false
+}
 
-	//C Pushes 'false' on the stack
-	ops["false"] = func() { ValueStack.Push(false) }
+// listItems returns the elements of any list-like value
+func listItems(val interface{}) ([]interface{}, bool) {
+	if items, ok := val.([]interface{}); ok {
+		return items, true
+	}
+	return persistentItems(val)
+}
 
-	//C Replaces the top-of-stack with 'true'
-	ops["false!"] = func() { ValueStack.Value[ValueStack.index-1] = false }
+// clampIndex maps an index into the range of a list of length n the same
+// way '@' does for lists: negative indexes count from the end and indexes
+// past either end refer to the first or last element.
+func clampIndex(idx int, n int) int {
+	if idx < 0 {
+		idx += n
+		if idx < 0 {
+			return 0
+		}
+	}
+	if idx >= n {
+		return n - 1
+	}
+	return idx
+}
 
-	//C Replaces the top-of-stack with the type of that value.
-	ops["type"] = func() {
-		val := ValueStack.Pop("valToGetTypeOf")
-		if !loop {
-			return
+// likeList converts a slice into the same kind of list as template
+func likeList(template interface{}, items []interface{}) interface{} {
+	switch template.(type) {
+	case *PVector:
+		return NewPVector(items)
+	case *PList:
+		return NewPList(items)
+	case BitSet:
+		if set, ok := NewBitSet(items); ok {
+			return set
 		}
-		ValueStack.Push(reflect.TypeOf(val))
 	}
+	return items
+}
 
-	//C Pushes the type 'int' on the top of stack. See also 'is'.
-	ops["^int"] = func() {
-		ValueStack.Push(reflect.TypeOf(1))
+// restoreListKind converts a list result on the top of the stack back into
+// the persistent type of template. List words that work on plain lists use
+// this so they return the same kind of value they were given.
+func restoreListKind(template interface{}) {
+	if !loop {
+		return
 	}
+	if items, ok := ValueStack.Tos().([]interface{}); ok {
+		ValueStack.SetTos(likeList(template, items))
+	}
+}
 
-	//C Pushes the type 'float' (float64) on the top of stack. See also 'is'.
-	ops["^float"] = func() {
-		ValueStack.Push(reflect.TypeOf(1.0))
+/*------------------------------------------------------------*/
+//
+// Lazy sequences. A sequence computes its elements on demand so it can be
+// infinite, and pipelines of 'map', 'filter', 'take' and 'skip' over a
+// sequence run in constant memory. Sequences are only realised by 'each',
+// 'reduce', 'len' or 'realize'.
+//
+
+// Seq is a lazy, possibly infinite, sequence of values. Iter starts a new
+// pass over the elements so a sequence can be consumed more than once.
+type Seq struct {
+	Iter func() *SeqIter
+}
+
+// SeqIter is a single pass over a sequence. Next returns false when the
+// sequence is exhausted. Stop, if not nil, releases any resources held by
+// the iterator. It may be called before the sequence is exhausted.
+type SeqIter struct {
+	Next func() (interface{}, bool)
+	Stop func()
+}
+
+// Close stops the iterator if it has a Stop function
+func (it *SeqIter) Close() {
+	if it.Stop != nil {
+		it.Stop()
 	}
+}
 
-	//C Pushes the type 'string' on the top of stack. See also 'is'.
-	ops["^string"] = func() {
-		ValueStack.Push(reflect.TypeOf(""))
+func (s *Seq) String() string {
+	return "<seq>"
+}
+
+var seqType = reflect.TypeOf(&Seq{})
+
+// sliceSeq returns a sequence over the elements of a list
+func sliceSeq(items []interface{}) *Seq {
+	return &Seq{Iter: func() *SeqIter {
+		index := 0
+		return &SeqIter{Next: func() (interface{}, bool) {
+			if index >= len(items) {
+				return nil, false
+			}
+			index++
+			return items[index-1], true
+		}}
+	}}
+}
+
+// toSeq converts a sequence, list, vector or plist into a sequence
+func toSeq(val interface{}) (*Seq, bool) {
+	switch val := val.(type) {
+	case *Seq:
+		return val, true
+	case *PList:
+		return &Seq{Iter: func() *SeqIter {
+			l := val
+			return &SeqIter{Next: func() (interface{}, bool) {
+				if l.Len() == 0 {
+					return nil, false
+				}
+				head := l.First()
+				l = l.Rest()
+				return head, true
+			}}
+		}}, true
+	case *PVector:
+		return &Seq{Iter: func() *SeqIter {
+			index := 0
+			return &SeqIter{Next: func() (interface{}, bool) {
+				if index >= val.Len() {
+					return nil, false
+				}
+				index++
+				return val.Nth(index - 1), true
+			}}
+		}}, true
+	case []interface{}:
+		return sliceSeq(val), true
 	}
+	return nil, false
+}
 
-	//C Pushes the type 'func()' on the top of stack. See also 'is'.
-	ops["^lambda"] = func() {
-		ValueStack.Push(reflect.TypeOf(func() {}))
+// Each calls fn with each element of the sequence until the sequence is
+// exhausted, fn returns false or an error occurs.
+func (s *Seq) Each(fn func(interface{}) bool) {
+	it := s.Iter()
+	defer it.Close()
+	for loop {
+		val, ok := it.Next()
+		if !ok || !loop || !fn(val) {
+			return
+		}
 	}
+}
 
-	//C Pushes the type 'list' ([]interface{}) on the top of stack. See also 'is'.
-	ops["^list"] = func() {
-		ValueStack.Push(listType)
+// Realize computes all of the elements of the sequence and returns them as
+// a list. It never returns for an infinite sequence.
+func (s *Seq) Realize() []interface{} {
+	result := make([]interface{}, 0)
+	s.Each(func(val interface{}) bool {
+		result = append(result, val)
+		return true
+	})
+	return result
+}
+
+// Map returns a sequence whose elements are the results of applying prog
+// to each element. As with lists, nil results are dropped.
+func (s *Seq) Map(prog func()) *Seq {
+	return &Seq{Iter: func() *SeqIter {
+		src := s.Iter()
+		return &SeqIter{
+			Next: func() (interface{}, bool) {
+				for loop {
+					val, ok := src.Next()
+					if !ok || !loop {
+						return nil, false
+					}
+					ValueStack.Push(val)
+					prog()
+					result := ValueStack.Pop("progResult")
+					if !loop {
+						return nil, false
+					}
+					if result != nil {
+						return result, true
+					}
+				}
+				return nil, false
+			},
+			Stop: src.Close,
+		}
+	}}
+}
+
+// Filter returns a sequence of the elements for which prog is true
+func (s *Seq) Filter(prog func()) *Seq {
+	return &Seq{Iter: func() *SeqIter {
+		src := s.Iter()
+		return &SeqIter{
+			Next: func() (interface{}, bool) {
+				for loop {
+					val, ok := src.Next()
+					if !ok || !loop {
+						return nil, false
+					}
+					ValueStack.Push(val)
+					prog()
+					keep := ValueStack.Pop("progResult")
+					if !loop {
+						return nil, false
+					}
+					if isTrue(keep) {
+						return val, true
+					}
+				}
+				return nil, false
+			},
+			Stop: src.Close,
+		}
+	}}
+}
+
+// Take returns a sequence of at most the first n elements. No more than n
+// elements are ever pulled from the underlying sequence.
+func (s *Seq) Take(n int) *Seq {
+	return &Seq{Iter: func() *SeqIter {
+		src := s.Iter()
+		remaining := n
+		return &SeqIter{
+			Next: func() (interface{}, bool) {
+				if remaining <= 0 {
+					return nil, false
+				}
+				remaining--
+				return src.Next()
+			},
+			Stop: src.Close,
+		}
+	}}
+}
+
+// Skip returns a sequence without the first n elements
+func (s *Seq) Skip(n int) *Seq {
+	return &Seq{Iter: func() *SeqIter {
+		src := s.Iter()
+		skipped := false
+		return &SeqIter{
+			Next: func() (interface{}, bool) {
+				if !skipped {
+					skipped = true
+					for i := 0; i < n; i++ {
+						if _, ok := src.Next(); !ok {
+							return nil, false
+						}
+					}
+				}
+				return src.Next()
+			},
+			Stop: src.Close,
+		}
+	}}
+}
+
+// progFunc extracts the function to call from a prog value
+func progFunc(val interface{}) (func(), bool) {
+	switch val := val.(type) {
+	case op:
+		return val.fn, true
+	case func():
+		return val, true
 	}
+	return nil, false
+}
 
-	//C Pushes the type 'bool' on the top of stack. See also 'is'.
-	ops["^bool"] = func() {
-		ValueStack.Push(reflect.TypeOf(true))
+// nextValue returns the value after val when counting upwards
+func nextValue(val interface{}) interface{} {
+	switch x := val.(type) {
+	case int:
+		return addInt(x, 1)
+	case float64:
+		return x + 1
 	}
+	result, _ := numericOp('+', val, 1)
+	return result
+}
 
-	//C Pushes the type 'byte' on the top of stack. See also 'is'.
-	ops["^byte"] = (func() {
-		ValueStack.Push(reflect.TypeOf("a"[0]))
-	})
+/*------------------------------------------------------------*/
+//
+// Helpers for the Joy combinators. Many Joy combinators run a quotation
+// and then put the stack back the way it was, keeping only the result.
+//
 
-	//C Pushes the type 'type' on the top of stack. See also 'is'.
-	ops["^type"] = func() {
-		// Having to do this is crazy...
-		ValueStack.Push(reflect.TypeOf(reflect.TypeOf(1)))
+// saveStack copies the contents of the value stack
+func saveStack() []interface{} {
+	saved := make([]interface{}, ValueStack.index)
+	copy(saved, ValueStack.Value[:ValueStack.index])
+	return saved
+}
+
+// restoreStack replaces the contents of the value stack
+func restoreStack(saved []interface{}) {
+	for i := len(saved); i < ValueStack.index; i++ {
+		ValueStack.Value[i] = nil
 	}
+	copy(ValueStack.Value[:], saved)
+	ValueStack.index = len(saved)
+}
 
-	//C <val> <type> is -> <bool>
-	//C The 'is' function checks to see in <val> is of type <type>
-	ops["is"] = func() {
-		v2 := ValueStack.Pop("targetType")
-		v1 := ValueStack.Pop("value")
+// nullary runs a prog and returns the value it leaves on top of the
+// stack, leaving the stack as it was before the prog ran
+func nullary(prog func()) interface{} {
+	saved := saveStack()
+	prog()
+	result := ValueStack.Pop("result")
+	restoreStack(saved)
+	return result
+}
+
+// popProgs pops quotations off the stack; names are in stack order
+func popProgs(names ...string) ([]func(), bool) {
+	progs := make([]func(), len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		val := ValueStack.Pop(names[i])
 		if !loop {
-			return
+			return nil, false
 		}
-
-		switch v2 := v2.(type) {
-		case reflect.Type:
-			ValueStack.Push(reflect.TypeOf(v1) == v2)
-		default:
-			GfError("The second argument to 's' must be a type.")
+		prog, ok := progFunc(val)
+		if !ok {
+			GfError("the %s argument must be a lambda, not '%v'", names[i], val)
+			return nil, false
 		}
+		progs[i] = prog
 	}
+	return progs, true
+}
 
-	//C Indirect execution (apply) for a prog, function or script.
-	//C Example:  2 3 {+} & -> 5
-	//C           "foo" -> ... # execute the function or script named by "foo".
-	ops["&"] = func() {
-		val := ValueStack.Pop("programToinvoke")
+// popValues pops values off the stack; names are in stack order
+func popValues(names ...string) ([]interface{}, bool) {
+	vals := make([]interface{}, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		vals[i] = ValueStack.Pop(names[i])
 		if !loop {
-			return
+			return nil, false
 		}
+	}
+	return vals, true
+}
 
-		InvokeDynamic(val, activeFunction.tok)
+// pushValues pushes values onto the stack in order
+func pushValues(vals ...interface{}) {
+	for _, v := range vals {
+		ValueStack.Push(v)
 	}
+}
 
-	//C 2 3 {2 *} apply2 -> 4 6
-	//C The 'apply2' function takes a prog and applies it to the top 2 elements on the stack.
-	ops["apply2"] = func() {
-		fnval := ValueStack.Pop("programToinvoke")
+// stackDepthArg pops a non-negative count for words like 'pick' and checks
+// that the stack has at least that many values below it
+func stackDepthArg(name string, extra int) (int, bool) {
+	val := ValueStack.Pop("count")
+	if !loop {
+		return 0, false
+	}
+	n, ok := val.(int)
+	if !ok || n < 0 {
+		GfError("'%s' requires a non-negative integer, not '%v'", name, val)
+		return 0, false
+	}
+	if ValueStack.index < n+extra {
+		GfError("there must be at least %d values on the stack to call '%s'.", n+extra, name)
+		return 0, false
+	}
+	return n, true
+}
+
+// spreadProgs pops one value for each prog and applies the progs to
+// them in order, so the first prog gets the deepest value
+func spreadProgs(progs []func()) {
+	if ValueStack.index < len(progs) {
+		GfError("there must be at least %d values on the stack to apply the progs to.", len(progs))
+		return
+	}
+	vals := make([]interface{}, len(progs))
+	for i := len(vals) - 1; i >= 0; i-- {
+		vals[i] = ValueStack.Pop("value")
+	}
+	for i, prog := range progs {
+		ValueStack.Push(vals[i])
+		prog()
 		if !loop {
 			return
 		}
+	}
+}
 
-		var fn func()
-		switch fnval := fnval.(type) {
-		case op:
-			fn = fnval.fn
-		case func():
-			fn = fnval
-		default:
-			GfError("The argument to '&2' must be of type lambda(); not %t\n", fnval)
+// guardedPattern is a 'case' pattern with a guard, made by 'when'
+type guardedPattern struct {
+	pattern interface{}
+	guard   interface{}
+}
+
+func (g guardedPattern) String() string {
+	return fmt.Sprintf("%v when %v", g.pattern, g.guard)
+}
+
+// caseMatches checks if a 'case' pattern matches a value
+func caseMatches(pattern interface{}, val interface{}) bool {
+	switch pe := pattern.(type) {
+	case guardedPattern:
+		if !caseMatches(pe.pattern, val) || !loop {
+			return false
 		}
+		guard, _ := progFunc(pe.guard)
+		ValueStack.Push(val)
+		guard()
+		result := ValueStack.Pop("guardResult")
+		return loop && isTrue(result)
+	case op, func():
+		test, _ := progFunc(pe)
+		ValueStack.Push(val)
+		test()
+		result := ValueStack.Pop("testResult")
+		return loop && isTrue(result)
+	case *regexp.Regexp:
+		return pe.MatchString(fmt.Sprintf("%v", val))
+	case *RecordType:
+		r, ok := val.(*Record)
+		return ok && r.Type == pe
+	case reflect.Type:
+		return pe == reflect.TypeOf(val)
+	}
+	return Compare(pattern, val) == 0
+}
 
-		val := ValueStack.Pop("secondVal")
-		fn()
+// runCaseAction runs a 'case' action with the matched value on the stack,
+// or pushes it if it isn't a prog
+func runCaseAction(action interface{}, val interface{}) {
+	if prog, ok := progFunc(action); ok {
 		ValueStack.Push(val)
-		fn()
+		prog()
+		return
+	}
+	ValueStack.Push(action)
+}
+
+// runCondAction runs a 'cond' action or pushes it if it isn't a prog
+func runCondAction(action interface{}) {
+	if prog, ok := progFunc(action); ok {
+		prog()
+		return
 	}
+	ValueStack.Push(action)
+}
 
-	//C 1 2 3 {2 *} apply3 -> 2 4 6
-	//C The 'apply3' function takes a prog and applies it to the top 3 elements on the stack.
-	ops["apply3"] = func() {
-		fnval := ValueStack.Pop("programToinvoke")
-		if !loop {
+// joyArity makes the unary, binary and ternary combinators, which run a
+// prog as 'nullary' and then remove its arguments
+func joyArity(name string, args int) func() {
+	return func() {
+		progs, ok := popProgs("prog")
+		if !ok {
 			return
 		}
-
-		var fn func()
-		switch fnval := fnval.(type) {
-		case op:
-			fn = fnval.fn
-		case func():
-			fn = fnval
-		default:
-			GfError("The argument to 'apply3' must be of type lambda(); not %t\n", fnval)
+		if ValueStack.index < args {
+			GfError("'%s' requires %d arguments under the prog", name, args)
+			return
 		}
-
-		val3 := ValueStack.Pop("thirdVal")
-		val2 := ValueStack.Pop("secondVal")
-		fn()
-		ValueStack.Push(val2)
-		fn()
-		ValueStack.Push(val3)
-		fn()
-	}
-
-	//C [X Y ..] unstack -> ..Y X
-	//C The list [X Y ..] becomes the new stack.
-	ops["unstack"] = func() {
-		listVal := ValueStack.Pop("listVar")
+		result := nullary(progs[0])
 		if !loop {
 			return
 		}
+		ValueStack.index -= args
+		ValueStack.Push(result)
+	}
+}
 
-		var list []interface{}
-		switch listVal := listVal.(type) {
-		case []interface{}:
-			list = listVal
-		default:
-			GfError("the argument to 'stack' must be a list of values [ ... ]")
+// aggregateHas checks if a list, set, dictionary or string contains a value
+func aggregateHas(agg interface{}, val interface{}) bool {
+	switch agg := agg.(type) {
+	case BitSet:
+		n, ok := val.(int)
+		return ok && agg.Has(n)
+	case string:
+		return strings.Contains(agg, fmt.Sprint(val))
+	case *Dict:
+		_, ok := agg.Get(val)
+		return ok
+	}
+	items, _ := listItems(agg)
+	for _, item := range items {
+		if Compare(item, val) == 0 {
+			return true
 		}
+	}
+	return false
+}
 
-		for _, v := range list {
-			ValueStack.Push(v)
-		}
+// genrec implements the 'genrec' combinator. The rest of the recursion is
+// passed to R2 as a quotation.
+func genrec(cond, thenProg, rec1, rec2 func(), tok Token) {
+	if isTrue(nullary(cond)) {
+		thenProg()
+		return
 	}
+	rec1()
+	ValueStack.Push(op{fn: func() { genrec(cond, thenProg, rec1, rec2, tok) }, tok: tok})
+	rec2()
+}
 
-	//C .. X Y Z -> .. X Y Z [Z Y X ..]
-	//C Pushes the stack as a list.
-	ops["stack"] = func() {
-		result := make([]interface{}, ValueStack.index)
-		for i := ValueStack.index - 1; i >= 0; i-- {
-			result[i] = ValueStack.Value[i]
+// treerec implements the 'treerec' combinator
+func treerec(leaf, combine func(), tok Token) {
+	if _, isList := listItems(ValueStack.Tos()); !isList {
+		leaf()
+		return
+	}
+	ValueStack.Push(op{fn: func() { treerec(leaf, combine, tok) }, tok: tok})
+	combine()
+}
+
+// condlinrec runs the first clause whose condition is true. Clauses are
+// lists of {cond} {then} or {cond} {rec1} {rec2}; the last clause has no
+// condition.
+func condlinrec(clauses [][]func()) {
+	for i, clause := range clauses {
+		if i < len(clauses)-1 {
+			if !isTrue(nullary(clause[0])) {
+				if !loop {
+					return
+				}
+				continue
+			}
+			clause = clause[1:]
 		}
-		ValueStack.Push(result)
+		clause[0]()
+		if len(clause) > 1 && loop {
+			condlinrec(clauses)
+			if loop {
+				clause[1]()
+			}
+		}
+		return
 	}
+}
 
-	//C <X> <y> over -> <x> <y> <x>
-	//C The 'over' function copies the second item on the stack to the top of stack.
-	ops["over"] = func() {
-		if ValueStack.index > 1 {
-			ValueStack.Push(ValueStack.Value[ValueStack.index-2])
-		} else {
-			GfError("there need to be at least 2 elements on the stack to call 'over'.")
+/*------------------------------------------------------------*/
+//
+// Generators. A generator runs a block as a coroutine on its own goroutine
+// with its own stacks. Each call to 'yield' hands a value to the consumer
+// and suspends the block until the next value is requested. Only one of the
+// generator and its consumer runs at any time so the interpreter globals
+// are simply swapped on each hand-off.
+//
+
+type generator struct {
+	prog    func()
+	stack   *Stack
+	offsets *Stack
+	calls   *Stack
+	scope   *Scope
+	resume  chan bool
+	out     chan genResult
+	started bool
+	done    bool
+}
+
+type genResult struct {
+	val interface{}
+	ok  bool
+}
+
+// generatorStop is used to unwind a suspended generator that is being stopped
+type generatorStop struct{}
+
+// The generator whose body is currently running or nil
+var currentGenerator *generator
+
+func newGenerator(prog func(), scope *Scope) *generator {
+	return &generator{
+		prog:    prog,
+		stack:   &Stack{},
+		offsets: &Stack{},
+		calls:   &Stack{},
+		scope:   NewScope(scope),
+		resume:  make(chan bool),
+		out:     make(chan genResult),
+	}
+}
+
+func (g *generator) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(generatorStop); !ok {
+				panic(r)
+			}
 		}
+		g.out <- genResult{nil, false}
+	}()
+	if <-g.resume {
+		g.prog()
 	}
+}
 
-	//C Indicates the start of a list 'literal'
-	ops["["] = func() {
-		OffsetStack.Push(ValueStack.index)
+// switchTo transfers control to the generator and waits for it to yield
+// a value or finish.
+func (g *generator) switchTo(resume bool) genResult {
+	savedStack, savedOffsets, savedCalls := ValueStack, OffsetStack, CallStack
+	savedScope, savedGenerator, savedFunction := VariableTable, currentGenerator, activeFunction
+	ValueStack, OffsetStack, CallStack = g.stack, g.offsets, g.calls
+	VariableTable, currentGenerator = g.scope, g
+	g.resume <- resume
+	result := <-g.out
+	g.scope = VariableTable
+	ValueStack, OffsetStack, CallStack = savedStack, savedOffsets, savedCalls
+	VariableTable, currentGenerator, activeFunction = savedScope, savedGenerator, savedFunction
+	return result
+}
+
+// Next runs the generator until it yields its next value
+func (g *generator) Next() (interface{}, bool) {
+	if g.done || !loop {
+		return nil, false
+	}
+	if !g.started {
+		g.started = true
+		go g.run()
 	}
+	result := g.switchTo(true)
+	if !result.ok {
+		g.done = true
+	}
+	return result.val, result.ok
+}
 
-	//C Takes the values on the stack starting at the location marked by '['
-	//C through to the TOS and makes a list out of them.
-	ops["]"] = func() {
+// Stop unwinds a suspended generator so its goroutine exits
+func (g *generator) Stop() {
+	if g.started && !g.done {
+		g.done = true
+		g.switchTo(false)
+	}
+}
 
-		startIndex := OffsetStack.Pop("offsetOfStartOfList").(int)
-		if startIndex < 0 {
-			ValueStack.Push(make([]interface{}, 0))
-			return
+// yield is called from the generator body to hand a value to the consumer
+func (g *generator) yield(val interface{}) {
+	g.out <- genResult{val, true}
+	if !<-g.resume {
+		panic(generatorStop{})
+	}
+}
+
+/*------------------------------------------------------------*/
+//
+// Symbols are interned names written as :name. Two symbols with the same
+// name are always the same object so they compare by identity and make
+// cheap dictionary keys.
+//
+
+// Symbol is the GoForth symbol type
+type Symbol struct {
+	Name string
+}
+
+func (sym *Symbol) String() string {
+	return ":" + sym.Name
+}
+
+var symbolTable = make(map[string]*Symbol)
+
+// Intern returns the unique symbol with the given name
+func Intern(name string) *Symbol {
+	sym, ok := symbolTable[name]
+	if !ok {
+		sym = &Symbol{Name: name}
+		symbolTable[name] = sym
+	}
+	return sym
+}
+
+var symbolType = reflect.TypeOf(Intern(""))
+
+/*------------------------------------------------------------*/
+//
+// User-defined record types. 'RECORD point x y ;' creates a record type
+// named point with fields x and y, along with the words point:new, point:x,
+// point:y, point:set-x, point:set-y, point? and ^point. Records are
+// immutable; the setters return an updated copy.
+//
+
+// RecordType describes a user-defined record type
+type RecordType struct {
+	Name   string
+	Fields []string
+}
+
+func (rt *RecordType) String() string {
+	return rt.Name
+}
+
+// Record is an instance of a user-defined record type
+type Record struct {
+	Type   *RecordType
+	Values []interface{}
+}
+
+func (r *Record) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.Type.Name)
+	sb.WriteByte('{')
+	for i, field := range r.Type.Fields {
+		if i > 0 {
+			sb.WriteString(", ")
 		}
+		fmt.Fprintf(&sb, "%s: %v", field, r.Values[i])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
 
-		endIndex := ValueStack.index
-		if endIndex <= startIndex {
-			ValueStack.Push(make([]interface{}, 0))
+// Field returns the value of the named field
+func (r *Record) Field(name string) (interface{}, bool) {
+	for i, field := range r.Type.Fields {
+		if field == name {
+			return r.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+// The record types that have been defined, by name
+var recordTypes = make(map[string]*RecordType)
+
+// defineRecord creates a record type and the words that work with it
+func defineRecord(name string, fields []string) {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if seen[field] {
+			GfError("duplicate field '%s' in record '%s'", field, name)
 			return
 		}
+		seen[field] = true
+	}
 
-		index := endIndex - startIndex
-		arr := make([]interface{}, index)
-		for index > 0 {
-			index--
-			arr[index] = ValueStack.Pop("listElement")
+	rt := &RecordType{Name: name, Fields: fields}
+	prevType, existed := recordTypes[name]
+	definitions = append(definitions, definition{name: name, undo: func() {
+		if existed {
+			recordTypes[name] = prevType
+		} else {
+			delete(recordTypes, name)
 		}
+	}})
+	recordTypes[name] = rt
 
-		ValueStack.Push(arr)
-	}
+	defineWord(name+":new", func() {
+		values := make([]interface{}, len(fields))
+		for i := len(fields) - 1; i >= 0; i-- {
+			values[i] = ValueStack.Pop(fields[i])
+		}
+		if !loop {
+			return
+		}
+		ValueStack.Push(&Record{Type: rt, Values: values})
+	})
 
-	//C <x> <y> + -> <x+y>
-	//C The '+' function takes the top two values on the stack and adds them.
-	//C If the values are numbers, then simple addition is used. If the values
-	//C If the first value is a string, then string concatenation is used.
-	//C If the first value is a list then the second value is added to the end of the list.
-	ops["+"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
+	defineWord(name+"?", func() {
+		val := ValueStack.Pop("valToTest")
 		if !loop {
 			return
 		}
+		r, ok := val.(*Record)
+		ValueStack.Push(ok && r.Type == rt)
+	})
 
-		switch x := v1.(type) {
-		case float64:
-			switch y := v2.(type) {
-			case string:
-				fval, err := strconv.ParseFloat(y, 64)
-				if err != nil {
-					GfError("Can't add %v and %v: %s", v1, v2, err)
-					return
-				}
-				ValueStack.Push(x + fval)
-			case int:
-				ValueStack.Push(x + float64(y))
-			case float64:
-				ValueStack.Push(x + y)
+	defineWord("^"+name, func() {
+		ValueStack.Push(rt)
+	})
+
+	for i, field := range fields {
+		index := i
+		getter := name + ":" + field
+		defineWord(getter, func() {
+			val := ValueStack.Pop("record")
+			if !loop {
+				return
 			}
-		case int:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x + y)
-			case string:
-				ival, err := strconv.Atoi(y)
-				if err != nil {
-					GfError("Can't add %v and %v: %s", v1, v2, err)
-					return
-				}
-				ValueStack.Push(x + ival)
-			case float64:
-				ValueStack.Push(float64(x) + y)
+			r, ok := val.(*Record)
+			if !ok || r.Type != rt {
+				GfError("'%s' requires a %s record, not '%v'", getter, name, val)
+				return
 			}
-		case string:
-			switch y := v2.(type) {
-			case string:
-				ValueStack.Push(x + y)
-			default:
-				ValueStack.Push(x + fmt.Sprint(y))
+			ValueStack.Push(r.Values[index])
+		})
+
+		setter := name + ":set-" + field
+		defineWord(setter, func() {
+			newVal := ValueStack.Pop("newValue")
+			val := ValueStack.Pop("record")
+			if !loop {
+				return
 			}
-		case []interface{}:
-			ValueStack.Push(append(x, v2))
-		}
+			r, ok := val.(*Record)
+			if !ok || r.Type != rt {
+				GfError("'%s' requires a %s record, not '%v'", setter, name, val)
+				return
+			}
+			values := make([]interface{}, len(r.Values))
+			copy(values, r.Values)
+			values[index] = newVal
+			ValueStack.Push(&Record{Type: rt, Values: values})
+		})
 	}
+}
 
-	//C Get the successor value for the argument. If v is a number then the result us
-	//C v+1. If v is a string or list, its the value puts an empty element on the end.
-	ops["succ"] = func() {
-		v1 := ValueStack.Tos()
-		if !loop {
-			return
+/*------------------------------------------------------------*/
+//
+// Multimethods. 'METHOD name type ... == body ;' adds an implementation of
+// a word that is chosen by the types of the values on the top of the stack,
+// with the last type naming the top of stack. If no implementation
+// matches, the definition the word had before its first METHOD is called,
+// so builtins like '+', 'len', '@' and '.' can be extended for new types.
+//
+
+type method struct {
+	types []string
+	body  func()
+}
+
+type multiMethod struct {
+	name     string
+	methods  []*method
+	fallback interface{}
+}
+
+// The multimethods that have been defined, by name
+var multiMethods = make(map[string]*multiMethod)
+
+// typeNameMatches checks whether a value has the type with the given name
+func typeNameMatches(name string, val interface{}) bool {
+	switch name {
+	case "any":
+		return true
+	case "nil":
+		return val == nil
+	case "int":
+		_, ok := val.(int)
+		return ok
+	case "float":
+		_, ok := val.(float64)
+		return ok
+	case "big":
+		_, ok := val.(*big.Int)
+		return ok
+	case "rat":
+		_, ok := val.(*big.Rat)
+		return ok
+	case "dec":
+		_, ok := val.(Decimal)
+		return ok
+	case "complex":
+		_, ok := val.(complex128)
+		return ok
+	case "number":
+		return numericRank(val) != rankNone
+	case "string":
+		_, ok := val.(string)
+		return ok
+	case "bytes":
+		_, ok := val.(Bytes)
+		return ok
+	case "symbol":
+		_, ok := val.(*Symbol)
+		return ok
+	case "bool":
+		_, ok := val.(bool)
+		return ok
+	case "list":
+		_, ok := val.([]interface{})
+		return ok
+	case "vector":
+		_, ok := val.(*PVector)
+		return ok
+	case "plist":
+		_, ok := val.(*PList)
+		return ok
+	case "seq":
+		_, ok := val.(*Seq)
+		return ok
+	case "dict":
+		_, ok := val.(*Dict)
+		return ok
+	case "bitset":
+		_, ok := val.(BitSet)
+		return ok
+	case "time":
+		_, ok := val.(time.Time)
+		return ok
+	case "duration":
+		_, ok := val.(time.Duration)
+		return ok
+	case "lambda":
+		switch val.(type) {
+		case op, func():
+			return true
 		}
+		return false
+	case "record":
+		_, ok := val.(*Record)
+		return ok
+	}
+	r, ok := val.(*Record)
+	return ok && r.Type.Name == name
+}
 
-		switch x := v1.(type) {
-		case float64:
-			ValueStack.SetTos(x + 1.0)
-		case int:
-			ValueStack.SetTos(x + 1)
-		case string:
-			ValueStack.SetTos(x + " ")
-		case []interface{}:
-			ValueStack.SetTos(append(x, nil))
-		default:
-			GfError("Can't compute the successor of '%v'", x)
+// isTypeName checks that a name can be used as a type in a METHOD
+func isTypeName(name string) bool {
+	switch name {
+	case "any", "nil", "int", "float", "big", "rat", "dec", "complex", "number",
+		"string", "bytes", "symbol", "bool", "list", "vector", "plist", "seq",
+		"dict", "bitset", "time", "duration", "lambda", "record":
+		return true
+	}
+	_, ok := recordTypes[name]
+	return ok
+}
+
+// specificity counts the non-'any' types of a method
+func (m *method) specificity() int {
+	count := 0
+	for _, t := range m.types {
+		if t != "any" {
+			count++
 		}
 	}
+	return count
+}
 
-	//C Get the predecessor value of the argument.
-	//C 10 pred -> 9
-	//C 10.0 pred -> 9.0
-	//C "abcde" pred -> "bcde"
-	ops["pred"] = func() {
-		v1 := ValueStack.Pop("valToDecrement")
-		if !loop {
-			return
+func (m *method) matches() bool {
+	n := len(m.types)
+	if ValueStack.index < n {
+		return false
+	}
+	base := ValueStack.index - n
+	for i, t := range m.types {
+		if !typeNameMatches(t, ValueStack.Value[base+i]) {
+			return false
 		}
+	}
+	return true
+}
 
-		switch x := v1.(type) {
-		case float64:
-			ValueStack.Push(x - 1.0)
-		case int:
-			ValueStack.Push(x - 1)
-		case string:
-			if len(x) > 1 {
-				ValueStack.Push(string(x[1:]))
-			} else {
-				ValueStack.Push(x)
-			}
-		case []interface{}:
-			if len(x) > 1 {
-				ValueStack.Push(x[1:])
+// addMethod adds an implementation to a multimethod, creating the
+// multimethod if this is the first METHOD for the word. A method with the
+// same types as an existing one replaces it.
+func addMethod(name string, types []string, body func()) {
+	mm, ok := multiMethods[name]
+	if !ok {
+		mm = &multiMethod{name: name, fallback: ops[name]}
+		multiMethods[name] = mm
+		definitions = append(definitions, definition{name: name, undo: func() {
+			delete(multiMethods, name)
+			if mm.fallback != nil {
+				setWord(name, mm.fallback)
 			} else {
-				ValueStack.Push(x)
+				removeWord(name)
 			}
-		default:
-			GfError("Can't compute the predecessor of '%v'", x)
-		}
+		}})
+		setWord(name, mm.dispatch)
+	} else {
+		prevMethods := append([]*method(nil), mm.methods...)
+		definitions = append(definitions, definition{name: name, undo: func() {
+			mm.methods = prevMethods
+		}})
 	}
 
-	//C [1 2 3 4] uncons -> 1 [2 3 4]
-	//C 'uncons' splits a list into its head and tail values.
-	ops["uncons"] = func() {
-		vect := ValueStack.Pop("vector")
-		if !loop {
+	m := &method{types: types, body: body}
+	for i, existing := range mm.methods {
+		if strings.Join(existing.types, " ") == strings.Join(types, " ") {
+			mm.methods[i] = m
 			return
 		}
+	}
+	mm.methods = append(mm.methods, m)
 
-		if vect == nil {
-			ValueStack.Push(nil)
-			ValueStack.Push(make([]interface{}, 0))
+	// Try the most specific methods first
+	sort.SliceStable(mm.methods, func(i, j int) bool {
+		return mm.methods[i].specificity() > mm.methods[j].specificity()
+	})
+}
+
+func (mm *multiMethod) dispatch() {
+	for _, m := range mm.methods {
+		if m.matches() {
+			m.body()
+			return
 		}
+	}
 
-		switch x := vect.(type) {
-		case []interface{}:
-			if len(x) > 0 {
-				ValueStack.Push(x[0])
-				ValueStack.Push(x[1:])
+	if mm.fallback != nil {
+		InvokeDynamic(mm.fallback, activeFunction.tok)
+		return
+	}
+
+	n := 0
+	for _, m := range mm.methods {
+		if len(m.types) > n {
+			n = len(m.types)
+		}
+	}
+	if n > ValueStack.index {
+		n = ValueStack.index
+	}
+	argTypes := make([]string, 0, n)
+	for _, v := range ValueStack.Value[ValueStack.index-n : ValueStack.index] {
+		argTypes = append(argTypes, typeName(v))
+	}
+	GfError("no method '%s' for argument types [%s]", mm.name, strings.Join(argTypes, " "))
+}
+
+// typeName returns the GoForth name of the type of a value
+func typeName(val interface{}) string {
+	if r, ok := val.(*Record); ok {
+		return r.Type.Name
+	}
+	for _, name := range []string{"nil", "int", "float", "big", "rat", "dec", "complex",
+		"string", "bytes", "symbol", "bool", "list", "vector", "plist", "seq", "dict",
+		"bitset", "time", "duration", "lambda"} {
+		if typeNameMatches(name, val) {
+			return name
+		}
+	}
+	return fmt.Sprint(reflect.TypeOf(val))
+}
+
+/*------------------------------------------------------------*/
+//
+// Code as data. 'quote>list' turns the tokens of a block into a list where
+// words are symbols, literals are values and nested blocks are nested
+// lists. 'list>quote' compiles such a list back into a runnable block.
+//
+
+// isLiteralToken returns true if a token is a literal value rather than
+// a word or special form
+func isLiteralToken(tok Token) bool {
+	name := tok.Name
+	if tok.IsValue || len(name) == 0 {
+		return tok.IsValue
+	}
+	switch {
+	case name[0] == '"' || name[0] == '\'':
+		return true
+	case len(name) > 1 && name[0] == ':':
+		return true
+	case strings.HasPrefix(name, "b\"") || strings.HasPrefix(name, "x\"") || strings.HasPrefix(name, "r/"):
+		return true
+	case strings.HasPrefix(name, "S\""):
+		return true
+	case name[0] >= '0' && name[0] <= '9', len(name) > 1 && name[0] == '-' && name[1] >= '0' && name[1] <= '9':
+		// Words like 2dup start with a digit too
+		_, isWord := ops[name]
+		return !isWord
+	}
+	return false
+}
+
+// tokenValue computes the value of a literal token by compiling it
+func tokenValue(tok Token) interface{} {
+	if tok.IsValue {
+		return tok.Value
+	}
+	_, code := Compile([]Token{tok}, 0, "", nil)
+	if !loop || len(code) != 1 {
+		return nil
+	}
+	code[0].fn()
+	return ValueStack.Pop("literal")
+}
+
+// quoteToList converts the tokens of a block into a list
+func quoteToList(code []Token) []interface{} {
+	result := make([]interface{}, 0, len(code))
+	for index := 0; index < len(code) && loop; index++ {
+		tok := code[index]
+		switch {
+		case tok.Name == "{" && !tok.IsValue:
+			// Find the matching close brace
+			depth := 1
+			end := index + 1
+			for ; end < len(code); end++ {
+				if code[end].IsValue {
+					continue
+				}
+				if code[end].Name == "{" {
+					depth++
+				} else if code[end].Name == "}" {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			result = append(result, quoteToList(code[index+1:end]))
+			index = end
+		case isLiteralToken(tok):
+			val := tokenValue(tok)
+			if sym, ok := val.(*Symbol); ok {
+				// A symbol in the list means a word, so a literal symbol
+				// is quoted as the code that makes it
+				result = append(result, sym.Name, Intern("symbol!"))
 			} else {
-				ValueStack.Push(nil)
-				ValueStack.Push(make([]interface{}, 0))
+				result = append(result, val)
+			}
+		default:
+			result = append(result, Intern(tok.Name))
+		}
+	}
+	return result
+}
+
+// listToTokens converts a list into the tokens of a block
+func listToTokens(items []interface{}, tok Token) []Token {
+	result := make([]Token, 0, len(items))
+	for _, item := range items {
+		if sym, ok := item.(*Symbol); ok {
+			result = append(result, Token{File: tok.File, Name: sym.Name, Text: tok.Text, Line: tok.Line, Offset: tok.Offset})
+			continue
+		}
+		if nested, ok := listItems(item); ok {
+			open := tok
+			open.Name = "{"
+			result = append(result, open)
+			result = append(result, listToTokens(nested, tok)...)
+			close := tok
+			close.Name = "}"
+			result = append(result, close)
+			continue
+		}
+		result = append(result, Token{File: tok.File, Name: fmt.Sprint(item), Text: tok.Text, Line: tok.Line, Offset: tok.Offset, IsValue: true, Value: item})
+	}
+	return result
+}
+
+/*------------------------------------------------------------*/
+//
+// Macros. 'MACRO name == body ;' defines a word that runs while the code
+// that uses it is being compiled. The body can read the tokens that follow
+// with 'tok:next' and 'tok:peek' and add code to the function being
+// compiled with 'emit'.
+//
+
+type compileContext struct {
+	fields []Token
+	index  int
+	result *[]op
+	locals []string
+}
+
+// The macros that have been defined, by name
+var macros = make(map[string]func())
+
+// The compilations that macros are currently expanding into
+var compileContexts []*compileContext
+
+func currentCompileContext() *compileContext {
+	if len(compileContexts) == 0 {
+		GfError("this word can only be used inside a MACRO")
+		return nil
+	}
+	return compileContexts[len(compileContexts)-1]
+}
+
+// readToken converts the next token in the context into a value. Words
+// become symbols, literals become values and a {...} block is compiled
+// into a quotation. If advance is false the token isn't consumed.
+func (ctx *compileContext) readToken(advance bool) interface{} {
+	if ctx.index >= len(ctx.fields) {
+		GfError("unexpected end of input while expanding a macro")
+		return nil
+	}
+	tok := ctx.fields[ctx.index]
+	var val interface{}
+	next := ctx.index + 1
+	switch {
+	case tok.Name == "{" && !tok.IsValue:
+		offset, body := Compile(ctx.fields, ctx.index+1, "}", ctx.locals)
+		if !loop {
+			return nil
+		}
+		bodyPtr := &body
+		wrapper := op{fn: func() { Eval(*bodyPtr) }, tok: tok}
+		if offset > ctx.index+1 && offset <= len(ctx.fields) {
+			wrapper.code = ctx.fields[ctx.index+1 : offset-1]
+		}
+		val = wrapper
+		next = offset
+	case isLiteralToken(tok):
+		val = tokenValue(tok)
+	default:
+		val = Intern(tok.Name)
+	}
+	if advance {
+		ctx.index = next
+	}
+	return val
+}
+
+// emit compiles a value into the function being compiled. Symbols are
+// compiled as words, lists are compiled as code and anything else,
+// including blocks, is pushed as a literal.
+func (ctx *compileContext) emit(val interface{}, tok Token) {
+	var code []Token
+	switch v := val.(type) {
+	case *Symbol:
+		code = listToTokens([]interface{}{v}, tok)
+	case op:
+		*ctx.result = append(*ctx.result, op{fn: func() { ValueStack.Push(v) }, tok: tok})
+		return
+	default:
+		items, ok := listItems(val)
+		if !ok {
+			items = []interface{}{val}
+		}
+		code = listToTokens(items, tok)
+	}
+	_, ops := Compile(code, 0, "", ctx.locals)
+	*ctx.result = append(*ctx.result, ops...)
+}
+
+/*------------------------------------------------------------*/
+//
+// Forth compatibility. The FORTH directive loads forth.gf and switches the
+// rest of the file to Forth syntax: ': name ... ;' definitions, IF/ELSE/THEN,
+// DO/LOOP, BEGIN/UNTIL, VARIABLE, CONSTANT, CREATE/DOES> and friends. Words
+// are case-insensitive and the Forth versions of words live in ops with a
+// 'forth:' prefix so they don't change the meaning of GoForth code.
+// GOFORTH switches back.
+//
+
+// ReturnStack holds the Forth return stack, including DO loop parameters
+var ReturnStack *Stack = &Stack{}
+
+// True while compiling Forth code
+var forthMode bool
+
+var forthLoaded bool
+
+// Cells for VARIABLE, CREATE, ',' and ALLOT. Addresses are indexes.
+var forthMemory []interface{}
+
+// Words that use CREATE, which take the name of the word to create
+// from the code that calls them
+var forthDefiningWords = make(map[string]bool)
+
+// State used while compiling a ': ... ;' definition
+var forthCurrentDef string
+var forthInDefinition bool
+var forthSawCreate bool
+var forthSawExit bool
+var forthSawLeave bool
+
+// The number of DO loops around the code being compiled
+var forthLoopDepth int
+
+// The name passed to a defining word and the last word CREATEd
+var forthCreateName string
+var forthLastCreated string
+var forthLastCreatedAddr int
+
+// Panic values used to implement EXIT and LEAVE. The compiler only
+// allows them where there's a recover to catch them.
+type forthExit struct{}
+type forthLeave struct{}
+
+// forthCatchExit wraps a word that uses EXIT so EXIT returns from it
+func forthCatchExit(run func()) func() {
+	return func() {
+		rdepth, cdepth := ReturnStack.index, CallStack.index
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(forthExit); !ok {
+					panic(r)
+				}
+				ReturnStack.index, CallStack.index = rdepth, cdepth
+			}
+		}()
+		run()
+	}
+}
+
+// forthTerm checks if a token ends the Forth construct being compiled. The
+// terminator can be a space-separated list of words, e.g. "ELSE THEN".
+func forthTerm(name string, term string) bool {
+	if term == "" {
+		return false
+	}
+	upper := strings.ToUpper(name)
+	for _, t := range strings.Fields(term) {
+		if upper == t {
+			return true
+		}
+	}
+	return false
+}
+
+// forthLookup finds the word a Forth name refers to. Forth versions of
+// words take precedence, then GoForth words. Unknown names are assumed to
+// be Forth words that will be defined later.
+func forthLookup(name string) string {
+	upper := strings.ToUpper(name)
+	if _, ok := ops["forth:"+upper]; ok {
+		return "forth:" + upper
+	}
+	if _, ok := ops[name]; ok {
+		return name
+	}
+	if _, ok := ops[strings.ToLower(name)]; ok {
+		return strings.ToLower(name)
+	}
+	return "forth:" + upper
+}
+
+// forthInt converts a value to a Forth cell, treating flags as -1 and 0
+func forthInt(val interface{}, name string) (int, bool) {
+	switch v := val.(type) {
+	case int:
+		return v, true
+	case bool:
+		if v {
+			return -1, true
+		}
+		return 0, true
+	case rune:
+		return int(v), true
+	}
+	GfError("'%s' requires an integer, not '%v'", name, val)
+	return 0, false
+}
+
+// forthAddress validates a Forth memory address
+func forthAddress(val interface{}, name string) (int, bool) {
+	addr, ok := forthInt(val, name)
+	if !ok {
+		return 0, false
+	}
+	if addr < 0 || addr >= len(forthMemory) {
+		GfError("'%s': invalid address %d", name, addr)
+		return 0, false
+	}
+	return addr, true
+}
+
+// forthCompileUntil compiles the tokens up to one of the terminators,
+// returning the index after it and the terminator that was found.
+func forthCompileUntil(fields []Token, start int, term string, f Token) (int, string, []op) {
+	offset, body := Compile(fields, start, term, nil)
+	if !loop {
+		return 0, "", nil
+	}
+	if offset < 1 || offset > len(fields) || !forthTerm(fields[offset-1].Name, term) {
+		activeFunction = op{fn: nil, tok: f}
+		GfError("missing %s after '%s'", strings.Replace(term, " ", " or ", -1), f.Name)
+		return 0, "", nil
+	}
+	return offset, strings.ToUpper(fields[offset-1].Name), body
+}
+
+// compileForth compiles the Forth construct at fields[index]. It returns
+// the index of the next token, whether the token was handled and whether
+// the enclosing definition is finished (after DOES>).
+func compileForth(fields []Token, index int, result *[]op) (int, bool, bool) {
+	f := fields[index]
+	upper := strings.ToUpper(f.Name)
+
+	// Numbers and strings are compiled as usual unless they name a Forth word
+	if strings.HasPrefix(f.Name, ".\"") {
+		return index, false, false
+	}
+	if _, isWord := ops[forthLookup(f.Name)]; isLiteralToken(f) && !isWord {
+		return index, false, false
+	}
+
+	switch upper {
+	case "GOFORTH":
+		forthMode = false
+		return index + 1, true, false
+
+	case "(":
+		// Comment up to the closing paren
+		for index < len(fields) && !strings.HasSuffix(fields[index].Name, ")") {
+			index++
+		}
+		return index + 1, true, false
+
+	case "\\":
+		// Comment to the end of the line
+		line := f.Line
+		for index < len(fields) && fields[index].Line == line {
+			index++
+		}
+		return index, true, false
+
+	case ":":
+		if index+1 >= len(fields) {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("missing name after ':', syntax is: : <name> ... ;")
+			return 0, true, false
+		}
+		name := strings.ToUpper(fields[index+1].Name)
+		defToken := fields[index+1]
+
+		oldDef, oldIn := forthCurrentDef, forthInDefinition
+		oldCreate, oldExit, oldDepth := forthSawCreate, forthSawExit, forthLoopDepth
+		forthCurrentDef, forthInDefinition = name, true
+		forthSawCreate, forthSawExit, forthLoopDepth = false, false, 0
+		offset, body := Compile(fields, index+2, ";", nil)
+		usesExit, definesWords := forthSawExit, forthSawCreate
+		forthCurrentDef, forthInDefinition = oldDef, oldIn
+		forthSawCreate, forthSawExit, forthLoopDepth = oldCreate, oldExit, oldDepth
+		if !loop {
+			return 0, true, false
+		}
+
+		word := func() {
+			CallStack.Push(defToken)
+			Eval(body)
+			CallStack.Pop("funcExit")
+		}
+		if usesExit {
+			word = forthCatchExit(word)
+		}
+		if definesWords {
+			forthDefiningWords[name] = true
+		}
+		defineWord("forth:"+name, word)
+		return offset, true, false
+
+	case "RECURSE":
+		cell := wordCellFor("forth:" + forthCurrentDef)
+		*result = append(*result, op{fn: cell.call, tok: f})
+		return index + 1, true, false
+
+	case "EXIT":
+		if !forthInDefinition {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("EXIT can only be used in a ': ... ;' definition")
+			return 0, true, false
+		}
+		forthSawExit = true
+		*result = append(*result, op{fn: func() { panic(forthExit{}) }, tok: f})
+		return index + 1, true, false
+
+	case "IF":
+		offset, found, thenPart := forthCompileUntil(fields, index+1, "ELSE THEN", f)
+		if !loop {
+			return 0, true, false
+		}
+		var elsePart []op
+		if found == "ELSE" {
+			offset, _, elsePart = forthCompileUntil(fields, offset, "THEN", f)
+			if !loop {
+				return 0, true, false
+			}
+		}
+		*result = append(*result, op{fn: func() {
+			cond := ValueStack.Pop("flag")
+			if !loop {
+				return
+			}
+			if isTrue(cond) {
+				Eval(thenPart)
+			} else {
+				Eval(elsePart)
+			}
+		}, tok: f})
+		return offset, true, false
+
+	case "BEGIN":
+		offset, found, body := forthCompileUntil(fields, index+1, "UNTIL WHILE AGAIN", f)
+		if !loop {
+			return 0, true, false
+		}
+		var whileBody []op
+		if found == "WHILE" {
+			offset, _, whileBody = forthCompileUntil(fields, offset, "REPEAT", f)
+			if !loop {
+				return 0, true, false
+			}
+		}
+		*result = append(*result, op{fn: func() {
+			for loop {
+				Eval(body)
+				if !loop || found == "AGAIN" {
+					continue
+				}
+				flag := ValueStack.Pop("flag")
+				if !loop {
+					return
+				}
+				if found == "UNTIL" {
+					if isTrue(flag) {
+						return
+					}
+					continue
+				}
+				if !isTrue(flag) {
+					return
+				}
+				Eval(whileBody)
+			}
+		}, tok: f})
+		return offset, true, false
+
+	case "DO", "?DO":
+		oldLeave := forthSawLeave
+		forthSawLeave = false
+		forthLoopDepth++
+		offset, found, body := forthCompileUntil(fields, index+1, "LOOP +LOOP", f)
+		forthLoopDepth--
+		usesLeave := forthSawLeave
+		forthSawLeave = oldLeave
+		if !loop {
+			return 0, true, false
+		}
+		checkFirst := upper == "?DO"
+		plusLoop := found == "+LOOP"
+		*result = append(*result, op{fn: func() {
+			startVal := ValueStack.Pop("start")
+			limitVal := ValueStack.Pop("limit")
+			if !loop {
+				return
+			}
+			start, ok1 := forthInt(startVal, f.Name)
+			limit, ok2 := forthInt(limitVal, f.Name)
+			if !ok1 || !ok2 || (checkFirst && start == limit) {
+				return
+			}
+
+			rbase := ReturnStack.index
+			defer func() { ReturnStack.index = rbase }()
+			if usesLeave {
+				defer func() {
+					if r := recover(); r != nil {
+						if _, ok := r.(forthLeave); !ok {
+							panic(r)
+						}
+					}
+				}()
+			}
+			ReturnStack.Push(limit)
+			ReturnStack.Push(start)
+			for loop {
+				Eval(body)
+				if !loop {
+					return
+				}
+				step := 1
+				if plusLoop {
+					var ok bool
+					if step, ok = forthInt(ValueStack.Pop("step"), "+LOOP"); !ok {
+						return
+					}
+				}
+				idx := ReturnStack.Value[ReturnStack.index-1].(int)
+				next := idx + step
+				ReturnStack.Value[ReturnStack.index-1] = next
+				// Stop when the index crosses the boundary between limit-1 and limit
+				if (idx-limit)^(next-limit) < 0 {
+					return
+				}
+			}
+		}, tok: f})
+		return offset, true, false
+
+	case "LEAVE":
+		if forthLoopDepth == 0 {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("LEAVE can only be used in a DO ... LOOP")
+			return 0, true, false
+		}
+		forthSawLeave = true
+		*result = append(*result, op{fn: func() { panic(forthLeave{}) }, tok: f})
+		return index + 1, true, false
+
+	case "VARIABLE", "CREATE", "CONSTANT":
+		if upper == "CREATE" && forthInDefinition {
+			// Inside a defining word the name comes from the caller
+			forthSawCreate = true
+			*result = append(*result, op{fn: func() {
+				if forthCreateName == "" {
+					GfError("CREATE in a definition needs a name from the code that calls it")
+					return
+				}
+				forthCreate(forthCreateName)
+				forthCreateName = ""
+			}, tok: f})
+			return index + 1, true, false
+		}
+		if index+1 >= len(fields) {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("missing name after '%s'", f.Name)
+			return 0, true, false
+		}
+		name := strings.ToUpper(fields[index+1].Name)
+		switch upper {
+		case "VARIABLE":
+			*result = append(*result, op{fn: func() {
+				forthCreate(name)
+				forthMemory = append(forthMemory, 0)
+			}, tok: f})
+		case "CREATE":
+			*result = append(*result, op{fn: func() { forthCreate(name) }, tok: f})
+		case "CONSTANT":
+			*result = append(*result, op{fn: func() {
+				val := ValueStack.Pop("value")
+				if !loop {
+					return
+				}
+				defineWord("forth:"+name, func() { ValueStack.Push(val) })
+			}, tok: f})
+		}
+		return index + 2, true, false
+
+	case "DOES>":
+		if !forthInDefinition {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("DOES> can only be used in a ': ... ;' definition")
+			return 0, true, false
+		}
+		// The DOES> code runs later, on its own, so it catches its own EXIT
+		oldExit, oldDepth := forthSawExit, forthLoopDepth
+		forthSawExit, forthLoopDepth = false, 0
+		offset, doesBody := Compile(fields, index+1, ";", nil)
+		usesExit := forthSawExit
+		forthSawExit, forthLoopDepth = oldExit, oldDepth
+		if !loop {
+			return 0, true, false
+		}
+		*result = append(*result, op{fn: func() {
+			addr := forthLastCreatedAddr
+			does := func() {
+				ValueStack.Push(addr)
+				Eval(doesBody)
+			}
+			if usesExit {
+				does = forthCatchExit(does)
+			}
+			setWord(forthLastCreated, does)
+		}, tok: f})
+		return offset, true, true
+	}
+
+	if forthDefiningWords[upper] && upper != forthCurrentDef {
+		// A word that uses CREATE takes the name of the new word
+		if index+1 >= len(fields) {
+			activeFunction = op{fn: nil, tok: f}
+			GfError("missing name after '%s'", f.Name)
+			return 0, true, false
+		}
+		newName := strings.ToUpper(fields[index+1].Name)
+		cell := wordCellFor("forth:" + upper)
+		*result = append(*result, op{fn: func() {
+			forthCreateName = newName
+			cell.call()
+		}, tok: f})
+		return index + 2, true, false
+	}
+
+	if upper == forthCurrentDef {
+		// A word isn't visible in its own definition; use RECURSE to recurse
+		prev, ok := ops["forth:"+upper]
+		if !ok {
+			name := forthLookup(f.Name)
+			if prev, ok = ops[name]; !ok || name == "forth:"+upper {
+				activeFunction = op{fn: nil, tok: f}
+				GfError("Undefined function '%s'; use RECURSE to call the word being defined", f.Name)
+				return 0, true, false
+			}
+		}
+		cell := &wordCell{name: f.Name, value: prev}
+		*result = append(*result, op{fn: cell.call, tok: f})
+		return index + 1, true, false
+	}
+
+	// Anything else is a call to a Forth or GoForth word
+	if _, isConst := constants[f.Name]; isConst {
+		return index, false, false
+	}
+	cell := wordCellFor(forthLookup(f.Name))
+	*result = append(*result, op{fn: cell.call, tok: f})
+	return index + 1, true, false
+}
+
+// forthBitOp makes a Forth word that combines two cells
+func forthBitOp(name string, fn func(a, b int) int) func() {
+	return func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		a, ok1 := forthInt(v1, name)
+		b, ok2 := forthInt(v2, name)
+		if ok1 && ok2 {
+			ValueStack.Push(fn(a, b))
+		}
+	}
+}
+
+// forthCreate defines a word that pushes the address of the next free cell
+func forthCreate(name string) {
+	addr := len(forthMemory)
+	forthLastCreated = "forth:" + name
+	forthLastCreatedAddr = addr
+	defineWord(forthLastCreated, func() { ValueStack.Push(addr) })
+}
+
+/*------------------------------------------------------------*/
+//
+// Byte strings hold binary data. Unlike strings, indexing a byte string
+// returns the byte value as an integer.
+//
+
+// Bytes is the GoForth byte string type
+type Bytes []byte
+
+// String formats the byte string as a b"..." literal
+func (b Bytes) String() string {
+	var sb strings.Builder
+	sb.WriteString("b\"")
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+var bytesType = reflect.TypeOf(Bytes{})
+
+var hexEscape = regexp.MustCompile(`\\x[0-9a-fA-F]{2}`)
+
+// parseBytesLiteral decodes the body of a b"..." literal. In addition to
+// the usual string escapes, \xNN gives a byte by its hex value.
+func parseBytesLiteral(str string) Bytes {
+	return Bytes(hexEscape.ReplaceAllFunc([]byte(str), func(m []byte) []byte {
+		val, _ := strconv.ParseUint(string(m[2:]), 16, 8)
+		return []byte{byte(val)}
+	}))
+}
+
+// normalizeOp creates a word that applies a Unicode normalization form
+func normalizeOp(name string, form norm.Form) func() {
+	return func() {
+		val := ValueStack.Pop("stringToNormalize")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case string:
+			ValueStack.Push(form.String(val))
+		default:
+			GfError("'%s' requires a string argument, not %v", name, reflect.TypeOf(val))
+		}
+	}
+}
+
+// sliceBounds converts start and end arguments, which may be negative to
+// count from the end, into valid slice bounds for a sequence of length n
+func sliceBounds(start int, end int, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > n {
+		end = n
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+/*------------------------------------------------------------*/
+//
+// Dates, times and durations. Times are time.Time values and durations are
+// time.Duration values which can be written as literals like 5m30s or 250ms.
+// The arithmetic operators combine them in the natural way:
+// time + duration -> time, time - time -> duration, duration * number -> duration.
+//
+
+var timeType = reflect.TypeOf(time.Time{})
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Named layouts accepted by time:format and time:parse in addition to Go
+// layout strings
+var timeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+func timeLayout(layout string) string {
+	if named, ok := timeLayouts[layout]; ok {
+		return named
+	}
+	return layout
+}
+
+// toDuration converts a duration, a duration string like "1h30m" or a
+// number of seconds into a time.Duration
+func toDuration(val interface{}) (time.Duration, bool) {
+	switch v := val.(type) {
+	case time.Duration:
+		return v, true
+	case string:
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	case int:
+		return time.Duration(v) * time.Second, true
+	case float64:
+		return time.Duration(v * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// timeOp implements the arithmetic operators for times and durations.
+// The second result is false if neither operand is a time or duration.
+func timeOp(op rune, v1 interface{}, v2 interface{}) (interface{}, bool) {
+	switch x := v1.(type) {
+	case time.Time:
+		switch y := v2.(type) {
+		case time.Duration:
+			switch op {
+			case '+':
+				return x.Add(y), true
+			case '-':
+				return x.Add(-y), true
+			}
+		case time.Time:
+			if op == '-' {
+				return x.Sub(y), true
+			}
+		}
+	case time.Duration:
+		switch y := v2.(type) {
+		case time.Duration:
+			switch op {
+			case '+':
+				return x + y, true
+			case '-':
+				return x - y, true
+			case '/':
+				if y == 0 {
+					GfError("division by zero.")
+					return nil, true
+				}
+				return float64(x) / float64(y), true
+			}
+		case time.Time:
+			if op == '+' {
+				return y.Add(x), true
+			}
+		case int:
+			switch op {
+			case '*':
+				return x * time.Duration(y), true
+			case '/':
+				if y == 0 {
+					GfError("division by zero.")
+					return nil, true
+				}
+				return x / time.Duration(y), true
+			}
+		case float64:
+			switch op {
+			case '*':
+				return time.Duration(float64(x) * y), true
+			case '/':
+				if y == 0 {
+					GfError("division by zero.")
+					return nil, true
+				}
+				return time.Duration(float64(x) / y), true
+			}
+		}
+	case int:
+		if y, ok := v2.(time.Duration); ok && op == '*' {
+			return time.Duration(x) * y, true
+		}
+	case float64:
+		if y, ok := v2.(time.Duration); ok && op == '*' {
+			return time.Duration(x * float64(y)), true
+		}
+	}
+	return nil, false
+}
+
+// timeAccessor creates a word that pushes a component of a time
+func timeAccessor(name string, fn func(t time.Time) interface{}) func() {
+	return func() {
+		val := ValueStack.Pop("time")
+		if !loop {
+			return
+		}
+		t, ok := val.(time.Time)
+		if !ok {
+			GfError("'%s' requires a time argument, not %v", name, reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(fn(t))
+	}
+}
+
+// durationAccessor creates a word that converts a duration to a number
+func durationAccessor(name string, fn func(d time.Duration) interface{}) func() {
+	return func() {
+		val := ValueStack.Pop("duration")
+		if !loop {
+			return
+		}
+		d, ok := val.(time.Duration)
+		if !ok {
+			GfError("'%s' requires a duration argument, not %v", name, reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(fn(d))
+	}
+}
+
+/*------------------------------------------------------------*/
+//
+// Arbitrary-precision integers. Integer arithmetic that overflows an int
+// is promoted to a *big.Int and big results that fit back into an int are
+// demoted again so the common case stays fast.
+//
+
+var bigType = reflect.TypeOf(big.NewInt(0))
+
+const minInt = -1 << (strconv.IntSize - 1)
+
+// Numeric ranks used to decide what type mixed operands are promoted to.
+const (
+	rankNone = iota
+	rankInt
+	rankBig
+	rankDecimal
+	rankRat
+	rankFloat
+	rankComplex
+)
+
+func numericRank(val interface{}) int {
+	switch val.(type) {
+	case int:
+		return rankInt
+	case *big.Int:
+		return rankBig
+	case Decimal:
+		return rankDecimal
+	case *big.Rat:
+		return rankRat
+	case float64:
+		return rankFloat
+	case complex128:
+		return rankComplex
+	default:
+		return rankNone
+	}
+}
+
+// normalizeBig returns the value as an int if it fits, otherwise as a *big.Int.
+func normalizeBig(b *big.Int) interface{} {
+	if b.IsInt64() {
+		i := b.Int64()
+		if int64(int(i)) == i {
+			return int(i)
+		}
+	}
+	return b
+}
+
+// toBig converts an integer value into a *big.Int.
+func toBig(val interface{}) (*big.Int, bool) {
+	switch val := val.(type) {
+	case int:
+		return big.NewInt(int64(val)), true
+	case *big.Int:
+		return val, true
+	default:
+		return nil, false
+	}
+}
+
+// toFloat converts any numeric value into a float64.
+func toFloat(val interface{}) (float64, bool) {
+	switch val := val.(type) {
+	case int:
+		return float64(val), true
+	case float64:
+		return val, true
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(val).Float64()
+		return f, true
+	case *big.Rat:
+		f, _ := val.Float64()
+		return f, true
+	case Decimal:
+		f, _ := val.Rat().Float64()
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// toComplex converts any numeric value into a complex128.
+func toComplex(val interface{}) (complex128, bool) {
+	if c, ok := val.(complex128); ok {
+		return c, true
+	}
+	f, ok := toFloat(val)
+	return complex(f, 0), ok
+}
+
+// toRat converts any exact numeric value into a *big.Rat.
+func toRat(val interface{}) (*big.Rat, bool) {
+	switch val := val.(type) {
+	case int:
+		return new(big.Rat).SetInt64(int64(val)), true
+	case *big.Int:
+		return new(big.Rat).SetInt(val), true
+	case *big.Rat:
+		return val, true
+	case Decimal:
+		return val.Rat(), true
+	default:
+		return nil, false
+	}
+}
+
+// exactRat converts a real number, including a finite float, into the
+// rational with exactly the same value.
+func exactRat(val interface{}) (*big.Rat, bool) {
+	if f, ok := val.(float64); ok {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(f), true
+	}
+	return toRat(val)
+}
+
+// normalizeRat returns a rational with a denominator of 1 as an integer.
+func normalizeRat(r *big.Rat) interface{} {
+	if r.IsInt() {
+		return normalizeBig(new(big.Int).Set(r.Num()))
+	}
+	return r
+}
+
+// parseInteger parses an integer literal, promoting it to a *big.Int if
+// it's too large for an int.
+func parseInteger(str string) (interface{}, bool) {
+	if num, err := strconv.Atoi(str); err == nil {
+		return num, true
+	}
+	num, ok := new(big.Int).SetString(str, 10)
+	if !ok {
+		return nil, false
+	}
+	return normalizeBig(num), true
+}
+
+func addInt(x, y int) interface{} {
+	r := x + y
+	if (r > x) == (y > 0) {
+		return r
+	}
+	return normalizeBig(new(big.Int).Add(big.NewInt(int64(x)), big.NewInt(int64(y))))
+}
+
+func subInt(x, y int) interface{} {
+	r := x - y
+	if (r < x) == (y > 0) {
+		return r
+	}
+	return normalizeBig(new(big.Int).Sub(big.NewInt(int64(x)), big.NewInt(int64(y))))
+}
+
+func mulInt(x, y int) interface{} {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	r := x * y
+	if r/y == x && r/x == y {
+		return r
+	}
+	return normalizeBig(new(big.Int).Mul(big.NewInt(int64(x)), big.NewInt(int64(y))))
+}
+
+func divInt(x, y int) interface{} {
+	if x == minInt && y == -1 {
+		return normalizeBig(new(big.Int).Neg(big.NewInt(int64(x))))
+	}
+	return x / y
+}
+
+// isExtendedNumber returns true for numeric values that aren't a plain int or float64.
+func isExtendedNumber(val interface{}) bool {
+	r := numericRank(val)
+	return r != rankNone && r != rankInt && r != rankFloat
+}
+
+// numericOp applies the arithmetic operator 'op' to two numbers when at
+// least one of them is of an extended numeric type. Both operands are promoted
+// to the wider of their two types before the operation is done. The boolean
+// result is false if the operator doesn't apply to the operands.
+func numericOp(op rune, v1 interface{}, v2 interface{}) (interface{}, bool) {
+	r1 := numericRank(v1)
+	r2 := numericRank(v2)
+	if r1 == rankNone || r2 == rankNone || !(isExtendedNumber(v1) || isExtendedNumber(v2)) {
+		return nil, false
+	}
+
+	rank := r1
+	if r2 > rank {
+		rank = r2
+	}
+
+	switch rank {
+	case rankBig:
+		x, _ := toBig(v1)
+		y, _ := toBig(v2)
+		result := new(big.Int)
+		switch op {
+		case '+':
+			result.Add(x, y)
+		case '-':
+			result.Sub(x, y)
+		case '*':
+			result.Mul(x, y)
+		case '/', '%':
+			if y.Sign() == 0 {
+				GfError("division by zero.")
+				return nil, true
+			}
+			if op == '/' {
+				result.Quo(x, y)
+			} else {
+				result.Rem(x, y)
+			}
+		default:
+			return nil, false
+		}
+		return normalizeBig(result), true
+
+	case rankDecimal:
+		x, _ := toDecimal(v1)
+		y, _ := toDecimal(v2)
+		scale := x.Scale
+		if y.Scale > scale {
+			scale = y.Scale
+		}
+		switch op {
+		case '+':
+			return Decimal{new(big.Int).Add(x.Rescale(scale).Unscaled, y.Rescale(scale).Unscaled), scale}, true
+		case '-':
+			return Decimal{new(big.Int).Sub(x.Rescale(scale).Unscaled, y.Rescale(scale).Unscaled), scale}, true
+		case '*':
+			return Decimal{new(big.Int).Mul(x.Unscaled, y.Unscaled), x.Scale + y.Scale}.Rescale(scale), true
+		case '/':
+			if y.Unscaled.Sign() == 0 {
+				GfError("division by zero.")
+				return nil, true
+			}
+			n := new(big.Int).Mul(x.Unscaled, pow10(y.Scale+scale))
+			d := new(big.Int).Mul(y.Unscaled, pow10(x.Scale))
+			return Decimal{roundQuo(n, d), scale}, true
+		default:
+			GfError("'%c' requires integer operands, not %v and %v", op, v1, v2)
+			return nil, true
+		}
+
+	case rankRat:
+		x, _ := toRat(v1)
+		y, _ := toRat(v2)
+		result := new(big.Rat)
+		switch op {
+		case '+':
+			result.Add(x, y)
+		case '-':
+			result.Sub(x, y)
+		case '*':
+			result.Mul(x, y)
+		case '/':
+			if y.Sign() == 0 {
+				GfError("division by zero.")
+				return nil, true
+			}
+			result.Quo(x, y)
+		default:
+			GfError("'%c' requires integer operands, not %v and %v", op, v1, v2)
+			return nil, true
+		}
+		return normalizeRat(result), true
+
+	case rankFloat:
+		x, _ := toFloat(v1)
+		y, _ := toFloat(v2)
+		switch op {
+		case '+':
+			return x + y, true
+		case '-':
+			return x - y, true
+		case '*':
+			return x * y, true
+		case '/':
+			if y == 0 {
+				GfError("division by zero.")
+				return nil, true
+			}
+			return x / y, true
+		case '%':
+			return math.Mod(x, y), true
+		}
+
+	case rankComplex:
+		x, _ := toComplex(v1)
+		y, _ := toComplex(v2)
+		switch op {
+		case '+':
+			return x + y, true
+		case '-':
+			return x - y, true
+		case '*':
+			return x * y, true
+		case '/':
+			if y == 0 {
+				GfError("division by zero.")
+				return nil, true
+			}
+			return x / y, true
+		default:
+			GfError("'%c' can't be applied to complex numbers %v and %v", op, v1, v2)
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// compareNumbers compares two numbers of any numeric type. Floats are compared
+// with exact values using the exact value of the float so the result is
+// consistent with the hash used for dictionary keys.
+func compareNumbers(v1 interface{}, v2 interface{}) int {
+	x, ok1 := toBig(v1)
+	y, ok2 := toBig(v2)
+	if ok1 && ok2 {
+		return x.Cmp(y)
+	}
+	_, f1 := v1.(float64)
+	_, f2 := v2.(float64)
+	if !(f1 && f2) {
+		rx, ok1 := exactRat(v1)
+		ry, ok2 := exactRat(v2)
+		if ok1 && ok2 {
+			return rx.Cmp(ry)
+		}
+	}
+	if numericRank(v1) == rankComplex || numericRank(v2) == rankComplex {
+		// Complex numbers have no natural order so sort by real then imaginary part
+		cx, _ := toComplex(v1)
+		cy, _ := toComplex(v2)
+		if r := compareNumbers(real(cx), real(cy)); r != 0 {
+			return r
+		}
+		return compareNumbers(imag(cx), imag(cy))
+	}
+	fx, _ := toFloat(v1)
+	fy, _ := toFloat(v2)
+	if fx > fy {
+		return 1
+	} else if fx < fy {
+		return -1
+	}
+	return 0
+}
+
+/*------------------------------------------------------------*/
+//
+// Exact rationals are represented as *big.Rat. Decimal is a fixed-scale
+// decimal number for things like money where binary floats won't do.
+//
+
+var ratType = reflect.TypeOf(big.NewRat(1, 1))
+var decimalType = reflect.TypeOf(Decimal{})
+
+// Decimal represents the value Unscaled * 10^-Scale. Arithmetic on decimals
+// keeps the larger scale of the two operands, rounding half to even.
+type Decimal struct {
+	Unscaled *big.Int
+	Scale    int
+}
+
+func (d Decimal) String() string {
+	digits := new(big.Int).Abs(d.Unscaled).String()
+	sign := ""
+	if d.Unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if d.Scale <= 0 {
+		return sign + digits
+	}
+	for len(digits) <= d.Scale {
+		digits = "0" + digits
+	}
+	point := len(digits) - d.Scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// Rat returns the exact value of the decimal as a rational.
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.Unscaled, pow10(d.Scale))
+}
+
+// Rescale returns the decimal with a new scale, rounding half to even if
+// digits are dropped.
+func (d Decimal) Rescale(scale int) Decimal {
+	if scale == d.Scale {
+		return d
+	}
+	if scale > d.Scale {
+		return Decimal{new(big.Int).Mul(d.Unscaled, pow10(scale-d.Scale)), scale}
+	}
+	return Decimal{roundQuo(d.Unscaled, pow10(d.Scale-scale)), scale}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// roundQuo computes n/d rounded half to even.
+func roundQuo(n *big.Int, d *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	r2 := new(big.Int).Abs(r)
+	r2.Lsh(r2, 1)
+	c := r2.Cmp(new(big.Int).Abs(d))
+	if c > 0 || (c == 0 && q.Bit(0) == 1) {
+		if (n.Sign() < 0) != (d.Sign() < 0) {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// parseDecimal parses a string like "-12.50" into a decimal.
+func parseDecimal(str string) (Decimal, bool) {
+	str = strings.TrimSpace(str)
+	scale := 0
+	if dot := strings.IndexByte(str, '.'); dot >= 0 {
+		scale = len(str) - dot - 1
+		str = str[:dot] + str[dot+1:]
+	}
+	unscaled, ok := new(big.Int).SetString(str, 10)
+	if !ok {
+		return Decimal{}, false
+	}
+	return Decimal{unscaled, scale}, true
+}
+
+// toDecimal converts an integer or decimal value into a decimal.
+func toDecimal(val interface{}) (Decimal, bool) {
+	switch val := val.(type) {
+	case Decimal:
+		return val, true
+	default:
+		if b, ok := toBig(val); ok {
+			return Decimal{b, 0}, true
+		}
+		return Decimal{}, false
+	}
+}
+
+// ratToDecimal rounds a rational to a decimal with the specified scale.
+func ratToDecimal(r *big.Rat, scale int) Decimal {
+	n := new(big.Int).Mul(r.Num(), pow10(scale))
+	return Decimal{roundQuo(n, r.Denom()), scale}
+}
+
+/*------------------------------------------------------------*/
+//
+// Helpers for the math word set.
+//
+
+var complexType = reflect.TypeOf(complex(0, 0))
+
+// mathOp returns a word that applies a float function to its argument,
+// or the complex variant of the function if the argument is complex.
+func mathOp(name string, ffn func(float64) float64, cfn func(complex128) complex128) func() {
+	return func() {
+		val := ValueStack.Pop("number")
+		if !loop {
+			return
+		}
+		if c, ok := val.(complex128); ok {
+			ValueStack.Push(cfn(c))
+			return
+		}
+		f, ok := toFloat(val)
+		if !ok {
+			GfError("'%s' requires a numeric argument, not '%v' [%t]", name, val, val)
+			return
+		}
+		ValueStack.Push(ffn(f))
+	}
+}
+
+// roundingOp returns a word that rounds its argument to an integer using the
+// float or rational rounding function. Integers are returned unchanged.
+func roundingOp(name string, ffn func(float64) float64, rfn func(*big.Rat) *big.Int) func() {
+	return func() {
+		val := ValueStack.Pop("number")
+		if !loop {
+			return
+		}
+		switch v := val.(type) {
+		case int, *big.Int:
+			ValueStack.Push(v)
+		case float64:
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				ValueStack.Push(v)
+				return
+			}
+			num, _ := big.NewFloat(ffn(v)).Int(nil)
+			ValueStack.Push(normalizeBig(num))
+		case *big.Rat, Decimal:
+			r, _ := toRat(v)
+			ValueStack.Push(normalizeBig(rfn(r)))
+		default:
+			GfError("'%s' requires a real numeric argument, not '%v' [%t]", name, val, val)
+		}
+	}
+}
+
+// ratFloor returns the largest integer less than or equal to r.
+func ratFloor(r *big.Rat) *big.Int {
+	// The denominator is always positive so Euclidean division is floor division
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+func ratCeil(r *big.Rat) *big.Int {
+	return new(big.Int).Neg(ratFloor(new(big.Rat).Neg(r)))
+}
+
+func ratTrunc(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// ratRound rounds half away from zero, the same as math.Round.
+func ratRound(r *big.Rat) *big.Int {
+	half := new(big.Rat).Add(new(big.Rat).Abs(r), big.NewRat(1, 2))
+	result := ratFloor(half)
+	if r.Sign() < 0 {
+		result.Neg(result)
+	}
+	return result
+}
+
+// absValue returns the absolute value of a number. The absolute value of a
+// complex number is its magnitude.
+func absValue(val interface{}) (interface{}, bool) {
+	switch v := val.(type) {
+	case int:
+		if v < 0 {
+			return subInt(0, v), true
+		}
+		return v, true
+	case *big.Int:
+		return new(big.Int).Abs(v), true
+	case float64:
+		return math.Abs(v), true
+	case *big.Rat:
+		return new(big.Rat).Abs(v), true
+	case Decimal:
+		return Decimal{new(big.Int).Abs(v.Unscaled), v.Scale}, true
+	case complex128:
+		return cmplx.Abs(v), true
+	default:
+		return nil, false
+	}
+}
+
+// powValue raises base to the power exp, keeping the result exact when both
+// are exact and the exponent is an integer.
+func powValue(base interface{}, exp interface{}) (interface{}, bool) {
+	if numericRank(base) == rankNone || numericRank(exp) == rankNone {
+		return nil, false
+	}
+	if numericRank(base) == rankComplex || numericRank(exp) == rankComplex {
+		b, _ := toComplex(base)
+		e, _ := toComplex(exp)
+		return cmplx.Pow(b, e), true
+	}
+	if e, ok := toBig(exp); ok && e.IsInt64() {
+		if b, ok := toBig(base); ok && e.Sign() >= 0 {
+			return normalizeBig(new(big.Int).Exp(b, e, nil)), true
+		}
+		if r, ok := toRat(base); ok && (r.Sign() != 0 || e.Sign() > 0) {
+			n := new(big.Int).Exp(r.Num(), new(big.Int).Abs(e), nil)
+			d := new(big.Int).Exp(r.Denom(), new(big.Int).Abs(e), nil)
+			if e.Sign() < 0 {
+				n, d = d, n
+			}
+			return normalizeRat(new(big.Rat).SetFrac(n, d)), true
+		}
+	}
+	b, _ := toFloat(base)
+	e, _ := toFloat(exp)
+	if b < 0 && e != math.Trunc(e) {
+		return cmplx.Pow(complex(b, 0), complex(e, 0)), true
+	}
+	return math.Pow(b, e), true
+}
+
+func binRecHelper(val interface{}, ifProg, thenProg, recProg, endProg func()) {
+	ValueStack.Push(val)
+	ifProg()
+	r := ValueStack.Pop("ifProgResult")
+	if !loop {
+		return
+	}
+	if isTrue(r) {
+		ValueStack.Push(val)
+		thenProg()
+		return
+	}
+	ValueStack.Push(val)
+	recProg()
+	val1 := ValueStack.Pop("rec1Val")
+	val2 := ValueStack.Pop("rec2val")
+	binRecHelper(val1, ifProg, thenProg, recProg, endProg)
+	val1 = ValueStack.Pop("rec1Result")
+	if !loop {
+		return
+	}
+	binRecHelper(val2, ifProg, thenProg, recProg, endProg)
+	val2 = ValueStack.Pop("rec2Result")
+	if !loop {
+		return
+	}
+	ValueStack.Push(val1)
+	ValueStack.Push(val2)
+
+	endProg()
+}
+
+func main() {
+
+	//C Causes subsequent functions to be stepped i.e. run one a time with the
+	//C current state of the stack displayed.
+	ops["step"] = func() {
+		step = true
+	}
+
+	ops["compare"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2))
+	}
+
+	//C Polymorphic function that compares two values of any type for equality.
+	ops["=="] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) == 0)
+	}
+
+	//C Polymorphic function that compares two values of any type for inequality.
+	ops["!="] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) != 0)
+	}
+
+	//C Returns true if the first value is less than the second.
+	ops[">"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) > 0)
+	}
+
+	//C Returns true if the first value is greater than or equal to the second.
+	ops[">="] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) >= 0)
+	}
+
+	//C Returns true if the first value is greater than the second.
+	ops["<"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) < 0)
+	}
+
+	//C Returns true if the first value is less than or equal to the second.
+	ops["<="] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		ValueStack.Push(Compare(v1, v2) <= 0)
+	}
+
+	//C true false and -> false
+	//C true true and -> true
+	//C Logical 'and' of two values.
+	ops["and"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		if s1, ok := v1.(BitSet); ok {
+			if s2, ok := v2.(BitSet); ok {
+				ValueStack.Push(s1 & s2)
+				return
+			}
+		}
+		ValueStack.Push(isTrue(v1) && isTrue(v2))
+	}
+
+	//C true false or -> true
+	//C false false or -> false
+	//C Logical 'or' of two values.
+	ops["or"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		if s1, ok := v1.(BitSet); ok {
+			if s2, ok := v2.(BitSet); ok {
+				ValueStack.Push(s1 | s2)
+				return
+			}
+		}
+		ValueStack.Push(isTrue(v1) || isTrue(v2))
+	}
+
+	//C true false xor -> true
+	//C true true xor -> false
+	//C Logical exclusive 'or' of two values. For two sets it returns the
+	//C members that are in only one of them.
+	ops["xor"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		if s1, ok := v1.(BitSet); ok {
+			if s2, ok := v2.(BitSet); ok {
+				ValueStack.Push(s1 ^ s2)
+				return
+			}
+		}
+		ValueStack.Push(isTrue(v1) != isTrue(v2))
+	}
+
+	//C Returns the keys in a dictionary as a list.
+	ops["keys"] = func() {
+		val := ValueStack.Pop("dictionary")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Dict:
+			keys := make([]interface{}, 0, val.Len())
+			for _, e := range val.Entries() {
+				keys = append(keys, e.Key)
+			}
+			ValueStack.Push(keys)
+		case map[string]interface{}:
+			names := make([]string, 0, len(val))
+			for k := range val {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			keys := make([]interface{}, 0, len(names))
+			for _, k := range names {
+				keys = append(keys, k)
+			}
+			ValueStack.Push(keys)
+		default:
+			GfError("The 'keys' function can only be used on a map, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C Returns the values in a dictionary as a list, in the same order as 'keys'.
+	ops["values"] = func() {
+		val := ValueStack.Pop("dictionary")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Dict:
+			values := make([]interface{}, 0, val.Len())
+			for _, e := range val.Entries() {
+				values = append(values, e.Value)
+			}
+			ValueStack.Push(values)
+		default:
+			GfError("The 'values' function can only be used on a dictionary, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C Returns the entries in a dictionary as a list of [key value] pairs.
+	ops["items"] = func() {
+		val := ValueStack.Pop("dictionary")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Dict:
+			items := make([]interface{}, 0, val.Len())
+			for _, e := range val.Entries() {
+				items = append(items, []interface{}{e.Key, e.Value})
+			}
+			ValueStack.Push(items)
+		default:
+			GfError("The 'items' function can only be used on a dictionary, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C Returns a new dictionary with the same entries ordered by key.
+	ops["sort-keys"] = func() {
+		val := ValueStack.Pop("dictionary")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Dict:
+			entries := make([]*DictEntry, val.Len())
+			copy(entries, val.Entries())
+			sort.SliceStable(entries, func(i, j int) bool {
+				return Compare(entries[i].Key, entries[j].Key) < 0
+			})
+			result := NewDict(len(entries))
+			for _, e := range entries {
+				result.Set(e.Key, e.Value)
+			}
+			ValueStack.Push(result)
+		default:
+			GfError("The 'sort-keys' function can only be used on a dictionary, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C Prints out the list of available functions.
+	ops["help"] = func() {
+		count := 0
+
+		for k := range ops {
+			fmt.Printf("%15s", k)
+			if count == 6 {
+				fmt.Println()
+				count = 0
+				continue
+			}
+			count++
+		}
+		fmt.Println()
+	}
+
+	//C 5 {@_} repeat -> 0 1 2 3 4
+	//C Repeats a prog <N> times. The iteration count, starting at 0, is available in
+	//C the block as @_. A nested 'repeat' has its own @_ and the outer value is restored
+	//C when it finishes. The results of each execution of the prog (if any) are pushed
+	//C onto the stack. See also: times, for
+	ops["repeat"] = func() {
+		val := ValueStack.Pop("program")
+		if !loop {
+			return
+		}
+		var body func()
+		switch val := val.(type) {
+		case op:
+			body = val.fn
+		case func():
+			body = val
+		default:
+			GfError("The second argument to 'repeat' must be a lambda, to %t", val)
+			return
+		}
+
+		iterval := ValueStack.Pop("itercount")
+		var itercount int
+		switch iterval := iterval.(type) {
+		case int:
+			itercount = iterval
+		case float64:
+			itercount = int(iterval)
+		default:
+			GfError("The first argument to 'repeat' must be an integer.")
+			return
+		}
+
+		oldval, ok := VariableTable.Get("_")
+		for i := 0; i < itercount; i++ {
+			if !loop {
+				break
+			}
+			VariableTable.Set("_", i) // BUGBUGBUG - do we really want to do this?
+			body()
+		}
+		if ok {
+			VariableTable.Set("_", oldval)
+		} else {
+			delete(VariableTable.Variables, "_")
+		}
+	}
+
+	//C <val> {<prog1>} {<prog2>} ifte -> <resultOfProg>
+	//C The 'ifte' function (if-then-else) takes a value and two progs.
+	//C If the value is true, then the first prog is executed. If it's
+	//C false, then the second prog is executed.
+	ops["if"] = func() {
+		val := ValueStack.Pop("condVal")
+		if !loop {
+			return
+		}
+		var body func()
+		switch val := val.(type) {
+		case op:
+			body = val.fn
+		case func():
+			body = val
+		default:
+			GfError("The first argument to 'repeat' must be a lambda, to %t", val)
+		}
+
+		cond := ValueStack.Pop("thenPart")
+		if !loop {
+			return
+		}
+
+		if isTrue(cond) {
+			body()
+		}
+	}
+
+	//C <val> {<prog>} if -> <resultOfProg>
+	//C The 'if' function takes a value and a prog. If the value is true,
+	//C then the first prog is executed. If it's false, then the second \
+	//C prog is executed. If the condition is a prog it's run as 'nullary'
+	//C and its result is used, as in Joy.
+	//C Example: 5 {0 >} {"positive"} {"negative"} ifte -> 5 "positive"
+	ops["ifte"] = func() {
+		elsePartVal := ValueStack.Pop("elsePart")
+		ifPartVal := ValueStack.Pop("thenPart")
+		cond := ValueStack.Pop("condVal")
+		if !loop {
+			return
+		}
+
+		var elsePart func()
+		switch val := elsePartVal.(type) {
+		case op:
+			elsePart = val.fn
+		case func():
+			elsePart = val
+		default:
+			GfError("The 'if' 'else' argument must be a lambda, to %t", val)
+		}
+
+		var ifPart func()
+		switch val := ifPartVal.(type) {
+		case op:
+			ifPart = val.fn
+		case func():
+			ifPart = val
+		default:
+			GfError("The 'if' 'then' argument must be a lambda, to %t", val)
+		}
+		if !loop {
+			return
+		}
+
+		if condProg, ok := progFunc(cond); ok {
+			cond = nullary(condProg)
+			if !loop {
+				return
+			}
+		}
+
+		if isTrue(cond) {
+			ifPart()
+		} else {
+			elsePart()
+		}
+	}
+
+	//C <val> [<pat1> <action1> <pat2> <action2> ... <default>] case
+	//C The case function takes a list of pattern/action pairs.
+	//C Patterns can be progs, regular expressoins, types or literals. If
+	//C a pattern matches, then the corresponding prog is executed
+	//C which may or may not leave a value on the stack. A pattern can have
+	//C a guard, written <pat> {guard} when, which must also be true for the
+	//C pattern to match. If the list has an odd number of elements the last
+	//C one is the default action. It's an error if nothing matches and there
+	//C is no default.
+	//C Example:  2 [1 "one" 2 "two" 3 "three"] case -> "two"
+	//C Example:  -4 [^int {0 <} when "negative" ^int "positive" "other"] case -> "negative"
+	ops["case"] = func() {
+		pattern := ValueStack.Pop("pattern")
+		val := ValueStack.Pop("valToMatch")
+		if !loop {
+			return
+		}
+
+		clauses, ok := listItems(pattern)
+		if !ok {
+			GfError("The second argument to 'case' must be a list")
+			return
+		}
+		for i := 0; i+1 < len(clauses); i += 2 {
+			matched := caseMatches(clauses[i], val)
+			if !loop {
+				return
+			}
+			if matched {
+				runCaseAction(clauses[i+1], val)
+				return
+			}
+		}
+		if len(clauses)%2 == 1 {
+			runCaseAction(clauses[len(clauses)-1], val)
+			return
+		}
+		GfError("no case matched the value '%v' and there is no default", val)
+	}
+
+	//C <pattern> {guard} when -> <guardedPattern>
+	//C Adds a guard to a 'case' pattern. The pattern only matches if the
+	//C guard, run with the value on the stack, is also true.
+	//C Example: 5 [^int {2 % 0 ==} when "even int" ^int "odd int"] case -> "odd int"
+	ops["when"] = func() {
+		guard := ValueStack.Pop("guard")
+		pattern := ValueStack.Pop("pattern")
+		if !loop {
+			return
+		}
+		if _, ok := progFunc(guard); !ok {
+			GfError("the guard for 'when' must be a lambda, not '%v'", guard)
+			return
+		}
+		ValueStack.Push(guardedPattern{pattern: pattern, guard: guard})
+	}
+
+	//C [{test1} {action1} {test2} {action2} ... {default}] cond
+	//C Runs the action for the first test that leaves a true value. The tests are
+	//C run as 'nullary' so they don't change the stack. If the list has an odd
+	//C number of elements the last one is run when no test is true. Actions that
+	//C aren't progs are pushed.
+	//C Example: 5 [{0 <} {pop "negative"} {0 ==} {pop "zero"} {pop "positive"}] cond -> "positive"
+	ops["cond"] = func() {
+		clausesVal := ValueStack.Pop("clauses")
+		if !loop {
+			return
+		}
+		clauses, ok := listItems(clausesVal)
+		if !ok {
+			GfError("'cond' requires a list of tests and actions, not '%v'", clausesVal)
+			return
+		}
+		for i := 0; i+1 < len(clauses); i += 2 {
+			result := clauses[i]
+			if test, ok := progFunc(result); ok {
+				result = nullary(test)
+				if !loop {
+					return
+				}
+			}
+			if isTrue(result) {
+				runCondAction(clauses[i+1])
+				return
+			}
+		}
+		if len(clauses)%2 == 1 {
+			runCondAction(clauses[len(clauses)-1])
+		}
+	}
+
+	//C Pushes 'true' on the stack
+	ops["true"] = func() { ValueStack.Push(true) }
+
+	//C Replaces the top-of-stack with 'true'
+	ops["true!"] = func() { ValueStack.Value[ValueStack.index-1] = true }
+
+	//C Pushes 'false' on the stack
+	ops["false"] = func() { ValueStack.Push(false) }
+
+	//C Replaces the top-of-stack with 'true'
+	ops["false!"] = func() { ValueStack.Value[ValueStack.index-1] = false }
+
+	//C Replaces the top-of-stack with the type of that value.
+	ops["type"] = func() {
+		val := ValueStack.Pop("valToGetTypeOf")
+		if !loop {
+			return
+		}
+		if r, ok := val.(*Record); ok {
+			ValueStack.Push(r.Type)
+			return
+		}
+		ValueStack.Push(reflect.TypeOf(val))
+	}
+
+	//C Pushes the type 'int' on the top of stack. See also 'is'.
+	ops["^int"] = func() {
+		ValueStack.Push(reflect.TypeOf(1))
+	}
+
+	//C Pushes the type 'float' (float64) on the top of stack. See also 'is'.
+	ops["^float"] = func() {
+		ValueStack.Push(reflect.TypeOf(1.0))
+	}
+
+	//C Pushes the type 'big' (*big.Int) on the top of stack. See also 'is'.
+	ops["^big"] = func() {
+		ValueStack.Push(bigType)
+	}
+
+	//C Pushes the type 'rat' (*big.Rat) on the top of stack. See also 'is'.
+	ops["^rat"] = func() {
+		ValueStack.Push(ratType)
+	}
+
+	//C Pushes the type 'dec' (fixed-scale decimal) on the top of stack. See also 'is'.
+	ops["^dec"] = func() {
+		ValueStack.Push(decimalType)
+	}
+
+	//C Pushes the type 'complex' (complex128) on the top of stack. See also 'is'.
+	ops["^complex"] = func() {
+		ValueStack.Push(complexType)
+	}
+
+	//C Pushes the type 'string' on the top of stack. See also 'is'.
+	ops["^string"] = func() {
+		ValueStack.Push(reflect.TypeOf(""))
+	}
+
+	//C Pushes the type 'func()' on the top of stack. See also 'is'.
+	ops["^lambda"] = func() {
+		ValueStack.Push(reflect.TypeOf(func() {}))
+	}
+
+	//C Pushes the type 'list' ([]interface{}) on the top of stack. See also 'is'.
+	ops["^list"] = func() {
+		ValueStack.Push(listType)
+	}
+
+	//C Pushes the type 'vector' (persistent vector) on the top of stack. See also 'is'.
+	ops["^vector"] = func() {
+		ValueStack.Push(vectorType)
+	}
+
+	//C Pushes the type 'plist' (persistent list) on the top of stack. See also 'is'.
+	ops["^plist"] = func() {
+		ValueStack.Push(plistType)
+	}
+
+	//C Pushes the type 'seq' (lazy sequence) on the top of stack. See also 'is'.
+	ops["^seq"] = func() {
+		ValueStack.Push(seqType)
+	}
+
+	//C Pushes the type 'bytes' (byte string) on the top of stack. See also 'is'.
+	ops["^bytes"] = func() {
+		ValueStack.Push(bytesType)
+	}
+
+	//C Pushes the type 'time' on the top of stack. See also 'is'.
+	ops["^time"] = func() {
+		ValueStack.Push(timeType)
+	}
+
+	//C Pushes the type 'duration' on the top of stack. See also 'is'.
+	ops["^duration"] = func() {
+		ValueStack.Push(durationType)
+	}
+
+	//C Pushes the type 'symbol' on the top of stack. See also 'is'.
+	ops["^symbol"] = func() {
+		ValueStack.Push(symbolType)
+	}
+
+	//C Pushes the type 'dict' on the top of stack. See also 'is'.
+	ops["^dict"] = func() {
+		ValueStack.Push(dictType)
+	}
+
+	//C Pushes the type 'bitset' on the top of stack. See also 'is'.
+	ops["^bitset"] = func() {
+		ValueStack.Push(bitSetType)
+	}
+
+	//C Pushes the type 'bool' on the top of stack. See also 'is'.
+	ops["^bool"] = func() {
+		ValueStack.Push(reflect.TypeOf(true))
+	}
+
+	//C Pushes the type 'byte' on the top of stack. See also 'is'.
+	ops["^byte"] = (func() {
+		ValueStack.Push(reflect.TypeOf("a"[0]))
+	})
+
+	//C Pushes the type 'type' on the top of stack. See also 'is'.
+	ops["^type"] = func() {
+		// Having to do this is crazy...
+		ValueStack.Push(reflect.TypeOf(reflect.TypeOf(1)))
+	}
+
+	//C <val> <type> is -> <bool>
+	//C The 'is' function checks to see in <val> is of type <type>
+	ops["is"] = func() {
+		v2 := ValueStack.Pop("targetType")
+		v1 := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+
+		switch v2 := v2.(type) {
+		case reflect.Type:
+			ValueStack.Push(reflect.TypeOf(v1) == v2)
+		case *RecordType:
+			r, ok := v1.(*Record)
+			ValueStack.Push(ok && r.Type == v2)
+		default:
+			GfError("The second argument to 's' must be a type.")
+		}
+	}
+
+	//C Indirect execution (apply) for a prog, function or script.
+	//C Example:  2 3 {+} & -> 5
+	//C           "foo" -> ... # execute the function or script named by "foo".
+	ops["&"] = func() {
+		val := ValueStack.Pop("programToinvoke")
+		if !loop {
+			return
+		}
+
+		InvokeDynamic(val, activeFunction.tok)
+	}
+
+	//C [X Y ..] unstack -> ..Y X
+	//C The list [X Y ..] becomes the new stack.
+	ops["unstack"] = func() {
+		listVal := ValueStack.Pop("listVar")
+		if !loop {
+			return
+		}
+
+		list, ok := listItems(listVal)
+		if !ok {
+			GfError("the argument to 'unstack' must be a list of values [ ... ], not '%v'", listVal)
+			return
+		}
+
+		for _, v := range list {
+			ValueStack.Push(v)
+		}
+	}
+
+	//C .. X Y Z -> .. X Y Z [Z Y X ..]
+	//C Pushes the stack as a list.
+	ops["stack"] = func() {
+		result := make([]interface{}, ValueStack.index)
+		for i := ValueStack.index - 1; i >= 0; i-- {
+			result[i] = ValueStack.Value[i]
+		}
+		ValueStack.Push(result)
+	}
+
+	//C <X> <y> over -> <x> <y> <x>
+	//C The 'over' function copies the second item on the stack to the top of stack.
+	ops["over"] = func() {
+		if ValueStack.index > 1 {
+			ValueStack.Push(ValueStack.Value[ValueStack.index-2])
+		} else {
+			GfError("there need to be at least 2 elements on the stack to call 'over'.")
+		}
+	}
+
+	//C Indicates the start of a list 'literal'
+	ops["["] = func() {
+		OffsetStack.Push(ValueStack.index)
+	}
+
+	//C Takes the values on the stack starting at the location marked by '['
+	//C through to the TOS and makes a list out of them.
+	ops["]"] = func() {
+
+		startIndex := OffsetStack.Pop("offsetOfStartOfList").(int)
+		if startIndex < 0 {
+			ValueStack.Push(make([]interface{}, 0))
+			return
+		}
+
+		endIndex := ValueStack.index
+		if endIndex <= startIndex {
+			ValueStack.Push(make([]interface{}, 0))
+			return
+		}
+
+		index := endIndex - startIndex
+		arr := make([]interface{}, index)
+		for index > 0 {
+			index--
+			arr[index] = ValueStack.Pop("listElement")
+		}
+
+		ValueStack.Push(arr)
+	}
+
+	//C <x> <y> + -> <x+y>
+	//C The '+' function takes the top two values on the stack and adds them.
+	//C If the values are numbers, then simple addition is used. If the values
+	//C If the first value is a string, then string concatenation is used.
+	//C If the first value is a list then the second value is added to the end of the list.
+	ops["+"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+
+		if result, ok := numericOp('+', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		if result, ok := timeOp('+', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		switch x := v1.(type) {
+		case float64:
+			switch y := v2.(type) {
+			case string:
+				fval, err := strconv.ParseFloat(y, 64)
+				if err != nil {
+					GfError("Can't add %v and %v: %s", v1, v2, err)
+					return
+				}
+				ValueStack.Push(x + fval)
+			case int:
+				ValueStack.Push(x + float64(y))
+			case float64:
+				ValueStack.Push(x + y)
+			}
+		case int:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(addInt(x, y))
+			case string:
+				ival, err := strconv.Atoi(y)
+				if err != nil {
+					GfError("Can't add %v and %v: %s", v1, v2, err)
+					return
+				}
+				ValueStack.Push(addInt(x, ival))
+			case float64:
+				ValueStack.Push(float64(x) + y)
+			}
+		case string:
+			switch y := v2.(type) {
+			case string:
+				ValueStack.Push(x + y)
+			default:
+				ValueStack.Push(x + fmt.Sprint(y))
+			}
+		case []interface{}:
+			ValueStack.Push(append(x, v2))
+		case *PVector:
+			ValueStack.Push(x.Conj(v2))
+		case *PList:
+			ValueStack.Push(NewPList(append(x.Items(), v2)))
+		case Bytes:
+			result := make(Bytes, len(x), len(x)+1)
+			copy(result, x)
+			switch y := v2.(type) {
+			case Bytes:
+				ValueStack.Push(append(result, y...))
+			case string:
+				ValueStack.Push(append(result, y...))
+			case int:
+				if y < 0 || y > 255 {
+					GfError("can't add %d to a byte string; bytes must be between 0 and 255", y)
+					return
+				}
+				ValueStack.Push(append(result, byte(y)))
+			default:
+				GfError("can't add a value of type %v to a byte string", reflect.TypeOf(v2))
+			}
+		}
+	}
+
+	//C Get the successor value for the argument. If v is a number then the result us
+	//C v+1. If v is a string or list, its the value puts an empty element on the end.
+	ops["succ"] = func() {
+		v1 := ValueStack.Tos()
+		if !loop {
+			return
+		}
+
+		switch x := v1.(type) {
+		case float64:
+			ValueStack.SetTos(x + 1.0)
+		case int:
+			ValueStack.SetTos(addInt(x, 1))
+		case *big.Int:
+			ValueStack.SetTos(normalizeBig(new(big.Int).Add(x, big.NewInt(1))))
+		case string:
+			ValueStack.SetTos(x + " ")
+		case []interface{}:
+			ValueStack.SetTos(append(x, nil))
+		default:
+			GfError("Can't compute the successor of '%v'", x)
+		}
+	}
+
+	//C Get the predecessor value of the argument.
+	//C 10 pred -> 9
+	//C 10.0 pred -> 9.0
+	//C "abcde" pred -> "bcde"
+	ops["pred"] = func() {
+		v1 := ValueStack.Pop("valToDecrement")
+		if !loop {
+			return
+		}
+
+		switch x := v1.(type) {
+		case float64:
+			ValueStack.Push(x - 1.0)
+		case int:
+			ValueStack.Push(subInt(x, 1))
+		case *big.Int:
+			ValueStack.Push(normalizeBig(new(big.Int).Sub(x, big.NewInt(1))))
+		case string:
+			if utf8.RuneCountInString(x) > 1 {
+				_, size := utf8.DecodeRuneInString(x)
+				ValueStack.Push(x[size:])
+			} else {
+				ValueStack.Push(x)
+			}
+		case []interface{}:
+			if len(x) > 1 {
+				ValueStack.Push(x[1:])
+			} else {
+				ValueStack.Push(x)
+			}
+		default:
+			GfError("Can't compute the predecessor of '%v'", x)
+		}
+	}
+
+	//C [1 2 3 4] uncons -> 1 [2 3 4]
+	//C 'uncons' splits a list into its head and tail values.
+	ops["uncons"] = func() {
+		vect := ValueStack.Pop("vector")
+		if !loop {
+			return
+		}
+
+		if vect == nil {
+			ValueStack.Push(nil)
+			ValueStack.Push(make([]interface{}, 0))
+		}
+
+		switch x := vect.(type) {
+		case []interface{}:
+			if len(x) > 0 {
+				ValueStack.Push(x[0])
+				ValueStack.Push(x[1:])
+			} else {
+				ValueStack.Push(nil)
+				ValueStack.Push(make([]interface{}, 0))
+			}
+		case *PList:
+			ValueStack.Push(x.First())
+			ValueStack.Push(x.Rest())
+		case *PVector:
+			if x.Len() > 0 {
+				ValueStack.Push(x.Nth(0))
+			} else {
+				ValueStack.Push(nil)
+			}
+			ValueStack.Push(x.Drop(1))
+		default:
+			ValueStack.Push(vect)
+			ValueStack.Push(make([]interface{}, 0))
+		}
+	}
+
+	//C [1 2 3] [4 5 6] append -> [1 2 3 4 5 6]
+	//C The 'append' functiono conccatenates two lists. Contrast this with '+'
+	//C where the second argument would become the last value in the list i.e.
+	//C [1 2 3] [4 5 6] + -> [1 2 3 [4 5 6]]
+	ops["append"] = func() {
+		v2 := ValueStack.Pop("list2")
+		v1 := ValueStack.Pop("list1")
+		if !loop {
+			return
+		}
+		if items, ok := persistentItems(v2); ok {
+			v2 = items
+		}
+		switch x := v1.(type) {
+		case []interface{}:
+			switch y := v2.(type) {
+			case []interface{}:
+				for _, v := range y {
+					x = append(x, v)
+				}
+				ValueStack.Push(x)
+			default:
+				ValueStack.Push(append(x, v2))
+			}
+		case *PVector:
+			switch y := v2.(type) {
+			case []interface{}:
+				for _, v := range y {
+					x = x.Conj(v)
+				}
+				ValueStack.Push(x)
+			default:
+				ValueStack.Push(x.Conj(v2))
+			}
+		case *PList:
+			// Only the first list needs to be copied
+			var result *PList
+			switch y := v2.(type) {
+			case []interface{}:
+				result = NewPList(y)
+			default:
+				result = emptyPList.Cons(v2)
+			}
+			items := x.Items()
+			for i := len(items) - 1; i >= 0; i-- {
+				result = result.Cons(items[i])
+			}
+			ValueStack.Push(result)
+		default:
+			result := []interface{}{v1}
+			switch y := v2.(type) {
+			case []interface{}:
+				for _, v := range y {
+					result = append(result, v)
+				}
+				ValueStack.Push(result)
+			default:
+				ValueStack.Push(append(result, v2))
+			}
+		}
+	}
+
+	//C 1 [2 3 4] cons -> [1 2 3 4]
+	//C Adds the second element on the stack to the front of the list. 'cons' is
+	//C the dual of 'uncons'
+	ops["cons"] = func() {
+		v2 := ValueStack.Pop("list")
+		v1 := ValueStack.Pop("valToCons")
+		if !loop {
+			return
+		}
+		switch v2 := v2.(type) {
+		case []interface{}:
+			v2 = append(v2, 0)
+			copy(v2[1:], v2)
+			v2[0] = v1
+			ValueStack.Push(v2)
+		case *PList:
+			ValueStack.Push(v2.Cons(v1))
+		case *PVector:
+			ValueStack.Push(NewPVector(append([]interface{}{v1}, v2.Items()...)))
+		case BitSet:
+			n, ok := v1.(int)
+			if !ok || n < 0 || n >= bitSetSize {
+				GfError("sets can only hold integers from 0 to %d, not '%v'", bitSetSize-1, v1)
+				return
+			}
+			ValueStack.Push(v2 | 1<<uint(n))
+		default:
+			GfError("the second argument to cons must be a list, not [%t]", v2)
+		}
+	}
+
+	//C <list> {<prog>} split -> <resultList1 resultList2
+	//C The 'split' function splits a list to pieces. If it is passed a prog, then
+	//C the list split base on the results of the prog applied to each element
+	//C Example: [1 2 3 4 5 6] {2 % 0 ==} list:split -> [1 3 5] [2 4 6]
+	//C Alternate use:
+	//C <list> <number> split -> <partition1> <partition2> ... <partitionN>
+	//C This function can also be used to partition a list into <number> length pieces.
+	//C Example: [1 2 3 4 5 6] 2 list:split -> [1 2] [3 4] [5 6]
+	ops["list:split"] = func() {
+		v2 := ValueStack.Pop("progOrValue")
+		v1 := ValueStack.Pop("listToSplit")
+		if !loop {
+			return
+		}
+
+		template := v1
+		if items, ok := persistentItems(v1); ok {
+			v1 = items
+		}
+
+		smaller := make([]interface{}, 0)
+		larger := make([]interface{}, 0)
+
+		switch x := v1.(type) {
+		case []interface{}:
+			switch y := v2.(type) {
+			case op:
+				for _, v := range x {
+					ValueStack.Push(v)
+					y.fn()
+					cond := ValueStack.Pop("progResult")
+					switch cond := cond.(type) {
+					case bool:
+						if cond {
+							larger = append(larger, v)
+						} else {
+							smaller = append(smaller, v)
+						}
+					default:
+						GfError("condition expression should return a boolean, not '%v'", cond)
+					}
+				}
+				ValueStack.Push(likeList(template, smaller))
+				ValueStack.Push(likeList(template, larger))
+			case func():
+				for _, v := range x {
+					ValueStack.Push(v)
+					y()
+					cond := ValueStack.Pop("progResult")
+					switch cond := cond.(type) {
+					case bool:
+						if cond {
+							larger = append(larger, v)
+						} else {
+							smaller = append(smaller, v)
+						}
+					default:
+						GfError("condition expression should return a boolean, not '%v'", cond)
+					}
+				}
+				ValueStack.Push(likeList(template, smaller))
+				ValueStack.Push(likeList(template, larger))
+			case int:
+				all := make([]interface{}, 0)
+				curr := make([]interface{}, 0, y)
+				for _, v := range x {
+					if len(curr) > 0 && len(curr)%y == 0 {
+						all = append(all, likeList(template, curr))
+						curr = make([]interface{}, 0, y)
+						curr = append(curr, v)
+
+					} else {
+						curr = append(curr, v)
+					}
+				}
+				if len(curr) > 0 {
+					all = append(all, likeList(template, curr))
+				}
+				ValueStack.Push(all)
+
+			default:
+				GfError("expression argument should be a lambda, not '%v'", y)
+			}
+		default:
+			GfError("the first argument must be a list, not '%v'", x)
+		}
+	}
+
+	//C Polymorphic function that tests to see if the stack is a truthy false.
+	ops["false?"] = func() {
+		v1 := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		ValueStack.Push(isFalse(v1))
+	}
+
+	//C Polymorphic function that tests to see if the stack is a truthy true.
+	ops["true?"] = func() {
+		v1 := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		ValueStack.Push(isTrue(v1))
+	}
+
+	//C <value> true! -> true
+	//C Replaces the top of with the value true. This function is equivalent to
+	//C pop true
+	ops["true!"] = func() {
+		ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+		ValueStack.Push(true)
+	}
+
+	//C <val> <number> * -> <multiplyResult>
+	//C The '*' function multiplies it's two arguments. It works for numbers
+	//C strings, and lists:
+	//C Example: 2 3 * -> 6
+	//C Example: "ab" 3 * -> "ababab"
+	//C Example: [1 2 3] 2 * -> [1 2 3 1 2 3]
+	ops["*"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+
+		if result, ok := numericOp('*', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		if result, ok := timeOp('*', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		switch x := v1.(type) {
+		case int:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(mulInt(x, y))
+			case float64:
+				ValueStack.Push(float64(x) * y)
+			default:
+				GfError("Cannot multiply '%s' and '%s'", v1, v2)
+			}
+		case float64:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(x * float64(y))
+			case float64:
+				ValueStack.Push(x * y)
+			default:
+				GfError("Cannot multiply '%s' and '%s'", v1, v2)
+			}
+		case string:
+			switch y := v2.(type) {
+			case int:
+				rstr := ""
+				for i := 0; i < y; i++ {
+					rstr += x
+				}
+				ValueStack.Push(rstr)
+			default:
+				GfError("Cannot multiply '%s' and '%s'", v1, v2)
+			}
+		case []interface{}:
+			switch y := v2.(type) {
+			case int:
+				result := make([]interface{}, 0, len(x)*y)
+				for i := 0; i < y; i++ {
+					result = append(result, x)
+				}
+				ValueStack.Push(result)
+			default:
+				GfError("Cannot multiply '%s' and '%s'", v1, v2)
+			}
+		default:
+			GfError("Cannot multiply '%s' and '%s'", v1, v2)
+		}
+	}
+
+	//C <val> <number> '-' -> <difference>
+	//C The '-' (subtraction) function subtracts the second value
+	//C from the first. It works on number, strings and lists:
+	//C 5 2 - -> 3
+	//C "abcde" 2 - -> "cde"
+	//C "[1 2 3 4 5] 2 - -> [3 4 5]
+	ops["-"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+
+		if result, ok := numericOp('-', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		if result, ok := timeOp('-', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		switch x := v1.(type) {
+		case int:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(subInt(x, y))
+			case float64:
+				ValueStack.Push(float64(x) - y)
+			default:
+				GfError("Can't subtract a value of type [%t] from an integer.")
+			}
+		case float64:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(x - float64(y))
+			case float64:
+				ValueStack.Push(x - y)
+			default:
+				GfError("Can't subtract a value of type [%t] from a floating point number.")
+			}
+		case string:
+			runes := []rune(x)
+			switch y := v2.(type) {
+			case int:
+				start, _ := sliceBounds(y, len(runes), len(runes))
+				ValueStack.Push(string(runes[start:]))
+			case float64:
+				start, _ := sliceBounds(int(y), len(runes), len(runes))
+				ValueStack.Push(string(runes[start:]))
+			case string:
+				start := strings.Index(x, y)
+				if start > -1 {
+					ValueStack.Push(string(x[0:start]) + string(x[start+len(y):]))
+				} else {
+					ValueStack.Push(x)
+				}
+			default:
+				GfError("Can't subtract a value of type [%t] from a string.")
+			}
+		case []interface{}:
+			switch y := v2.(type) {
+			case int:
+				if y < 0 {
+					y = len(x) + y
+				}
+				if y <= len(x) {
+					ValueStack.Push((x[y:]))
+				} else {
+					ValueStack.Push(nil)
+				}
+			case float64:
+				var i int
+				if y < 0 {
+					i = len(x) + int(y)
+				} else {
+					i = int(y)
+				}
+				if i <= len(x) {
+					ValueStack.Push(x[i:])
+				} else {
+					ValueStack.Push(nil)
+				}
+			default:
+				GfError("Can't subtract a value of type [%t] from a list.")
+			}
+
+		default:
+			GfError("Cannot subtract %s [%t] and %s [%t]", v1, v1, v2, v2)
+		}
+	}
+
+	//C Divides two numbers. Integers and floats can be freely mixed.
+	ops["/"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+
+		if result, ok := numericOp('/', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		if result, ok := timeOp('/', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		switch x := v1.(type) {
+		case int:
+			switch y := v2.(type) {
+			case int:
+				if y == 0 {
+					GfError("division by zero.")
+					return
+				}
+				ValueStack.Push(divInt(x, y))
+			case float64:
+				if y == 0 {
+					GfError("division by zero.")
+					return
+				}
+				ValueStack.Push(float64(x) / y)
+			}
+		case float64:
+			switch y := v2.(type) {
+			case int:
+				if y == 0 {
+					GfError("division by zero.")
+					return
+				}
+				ValueStack.Push(x / float64(y))
+			case float64:
+				if y == 0 {
+					GfError("division by zero.")
+					return
+				}
+				ValueStack.Push(x / y)
+			}
+		default:
+			GfError("Cannot divide %s by %s", v1, v2)
+		}
+	}
+
+	//C '%' computes the modulus of two numbers
+	//C Example: 10 3 % -> 1
+	ops["%"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+
+		if result, ok := numericOp('%', v1, v2); ok {
+			ValueStack.Push(result)
+			return
+		}
+
+		switch x := v1.(type) {
+		case int:
+			switch y := v2.(type) {
+			case int:
+				if y == 0 {
+					GfError("division by zero.")
+					return
+				}
+				ValueStack.Push(x % y)
+			case float64:
+				ValueStack.Push(x % int(y))
+			default:
+				GfError("Cannot use % with operands %s and %s", v1, v2)
+			}
+		case float64:
+			switch y := v2.(type) {
+			case int:
+				ValueStack.Push(int(x) % y)
+			case float64:
+				ValueStack.Push(int(x) % int(y))
+			default:
+				GfError("Cannot use % with operands %s and %s", v1, v2)
 			}
 		default:
-			ValueStack.Push(vect)
-			ValueStack.Push(make([]interface{}, 0))
+			GfError("Cannot use % with operands %s and %s", v1, v2)
 		}
 	}
 
-	//C [1 2 3] [4 5 6] append -> [1 2 3 4 5 6]
-	//C The 'append' functiono conccatenates two lists. Contrast this with '+'
-	//C where the second argument would become the last value in the list i.e.
-	//C [1 2 3] [4 5 6] + -> [1 2 3 [4 5 6]]
-	ops["append"] = func() {
-		v2 := ValueStack.Pop("list2")
-		v1 := ValueStack.Pop("list1")
+	//C -5 abs -> 5
+	//C Returns the absolute value of a number. For complex numbers this is the magnitude.
+	//C Example: 3+4i abs -> 5
+	ops["abs"] = func() {
+		val := ValueStack.Pop("number")
 		if !loop {
 			return
 		}
-		switch x := v1.(type) {
-		case []interface{}:
-			switch y := v2.(type) {
-			case []interface{}:
-				for _, v := range y {
-					x = append(x, v)
+		result, ok := absValue(val)
+		if !ok {
+			GfError("'abs' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		ValueStack.Push(result)
+	}
+
+	//C 3 5 max -> 5
+	//C Returns the larger of two values using the same ordering as 'compare'.
+	ops["max"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		if Compare(v1, v2) < 0 {
+			ValueStack.Push(v2)
+		} else {
+			ValueStack.Push(v1)
+		}
+	}
+
+	//C 3 5 min -> 3
+	//C Returns the smaller of two values using the same ordering as 'compare'.
+	ops["min"] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		if Compare(v1, v2) > 0 {
+			ValueStack.Push(v2)
+		} else {
+			ValueStack.Push(v1)
+		}
+	}
+
+	//C 16 math:sqrt -> 4
+	//C Returns the square root of a number. The square root of a perfect square integer
+	//C is an integer and the square root of a negative number is complex.
+	//C Example: -4 math:sqrt -> (0+2i)
+	ops["math:sqrt"] = func() {
+		val := ValueStack.Pop("number")
+		if !loop {
+			return
+		}
+		switch v := val.(type) {
+		case complex128:
+			ValueStack.Push(cmplx.Sqrt(v))
+			return
+		case int, *big.Int:
+			b, _ := toBig(v)
+			if b.Sign() >= 0 {
+				root := new(big.Int).Sqrt(b)
+				if new(big.Int).Mul(root, root).Cmp(b) == 0 {
+					ValueStack.Push(normalizeBig(root))
+					return
 				}
-				ValueStack.Push(x)
-			default:
-				ValueStack.Push(append(x, v2))
 			}
-		default:
-			result := []interface{}{v1}
-			switch y := v2.(type) {
-			case []interface{}:
-				for _, v := range y {
-					result = append(result, v)
+		}
+		f, ok := toFloat(val)
+		if !ok {
+			GfError("'math:sqrt' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		if f < 0 {
+			ValueStack.Push(cmplx.Sqrt(complex(f, 0)))
+			return
+		}
+		ValueStack.Push(math.Sqrt(f))
+	}
+
+	//C <base> <exponent> math:pow -> <result>
+	//C Raises base to the power exponent. The result is exact if the base is an exact
+	//C number and the exponent is an integer.
+	//C Example: 2 100 math:pow -> 1267650600228229401496703205376
+	//C Example: 2/3 2 math:pow -> 4/9
+	ops["math:pow"] = func() {
+		exp := ValueStack.Pop("exponent")
+		base := ValueStack.Pop("base")
+		if !loop {
+			return
+		}
+		result, ok := powValue(base, exp)
+		if !ok {
+			GfError("'math:pow' requires numeric arguments, not '%v' and '%v'", base, exp)
+			return
+		}
+		ValueStack.Push(result)
+	}
+
+	//C Returns the sine of a number (in radians).
+	ops["math:sin"] = mathOp("math:sin", math.Sin, cmplx.Sin)
+
+	//C Returns the cosine of a number (in radians).
+	ops["math:cos"] = mathOp("math:cos", math.Cos, cmplx.Cos)
+
+	//C Returns the tangent of a number (in radians).
+	ops["math:tan"] = mathOp("math:tan", math.Tan, cmplx.Tan)
+
+	//C Returns the arcsine of a number in radians.
+	ops["math:asin"] = mathOp("math:asin", math.Asin, cmplx.Asin)
+
+	//C Returns the arccosine of a number in radians.
+	ops["math:acos"] = mathOp("math:acos", math.Acos, cmplx.Acos)
+
+	//C Returns the arctangent of a number in radians.
+	ops["math:atan"] = mathOp("math:atan", math.Atan, cmplx.Atan)
+
+	//C Returns e raised to the power of the argument.
+	ops["math:exp"] = mathOp("math:exp", math.Exp, cmplx.Exp)
+
+	//C Returns the natural logarithm of a number.
+	ops["math:log"] = mathOp("math:log", math.Log, cmplx.Log)
+
+	//C Returns the base 10 logarithm of a number.
+	ops["math:log10"] = mathOp("math:log10", math.Log10, cmplx.Log10)
+
+	//C Returns the base 2 logarithm of a number.
+	ops["math:log2"] = mathOp("math:log2", math.Log2, func(c complex128) complex128 {
+		return cmplx.Log(c) / complex(math.Ln2, 0)
+	})
+
+	//C <y> <x> math:atan2 -> <angle>
+	//C Returns the arctangent of y/x using the signs of both to determine the quadrant.
+	ops["math:atan2"] = func() {
+		xval := ValueStack.Pop("x")
+		yval := ValueStack.Pop("y")
+		if !loop {
+			return
+		}
+		x, ok1 := toFloat(xval)
+		y, ok2 := toFloat(yval)
+		if !ok1 || !ok2 {
+			GfError("'math:atan2' requires real numeric arguments, not '%v' and '%v'", yval, xval)
+			return
+		}
+		ValueStack.Push(math.Atan2(y, x))
+	}
+
+	//C 2.7 math:floor -> 2
+	//C Returns the largest integer less than or equal to the argument.
+	ops["math:floor"] = roundingOp("math:floor", math.Floor, ratFloor)
+
+	//C 2.1 math:ceil -> 3
+	//C Returns the smallest integer greater than or equal to the argument.
+	ops["math:ceil"] = roundingOp("math:ceil", math.Ceil, ratCeil)
+
+	//C 2.5 math:round -> 3
+	//C Rounds the argument to the nearest integer, rounding halves away from zero.
+	ops["math:round"] = roundingOp("math:round", math.Round, ratRound)
+
+	//C -2.7 math:trunc -> -2
+	//C Returns the integer part of the argument.
+	ops["math:trunc"] = roundingOp("math:trunc", math.Trunc, ratTrunc)
+
+	//C Pushes the constant pi.
+	ops["math:pi"] = func() {
+		ValueStack.Push(math.Pi)
+	}
+
+	//C Pushes the constant e.
+	ops["math:e"] = func() {
+		ValueStack.Push(math.E)
+	}
+
+	//C <real> <imaginary> math:complex -> <complex>
+	//C Builds a complex number from its real and imaginary parts.
+	//C Example: 3 4 math:complex -> (3+4i)
+	ops["math:complex"] = func() {
+		imVal := ValueStack.Pop("imaginaryPart")
+		reVal := ValueStack.Pop("realPart")
+		if !loop {
+			return
+		}
+		re, ok1 := toFloat(reVal)
+		im, ok2 := toFloat(imVal)
+		if !ok1 || !ok2 {
+			GfError("'math:complex' requires real numeric arguments, not '%v' and '%v'", reVal, imVal)
+			return
+		}
+		ValueStack.Push(complex(re, im))
+	}
+
+	//C Returns the real part of a complex number.
+	ops["real"] = func() {
+		val := ValueStack.Pop("complexNumber")
+		if !loop {
+			return
+		}
+		c, ok := toComplex(val)
+		if !ok {
+			GfError("'real' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		ValueStack.Push(real(c))
+	}
+
+	//C Returns the imaginary part of a complex number.
+	ops["imag"] = func() {
+		val := ValueStack.Pop("complexNumber")
+		if !loop {
+			return
+		}
+		c, ok := toComplex(val)
+		if !ok {
+			GfError("'imag' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		ValueStack.Push(imag(c))
+	}
+
+	//C Returns the complex conjugate of a number.
+	ops["math:conj"] = func() {
+		val := ValueStack.Pop("complexNumber")
+		if !loop {
+			return
+		}
+		c, ok := toComplex(val)
+		if !ok {
+			GfError("'math:conj' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		ValueStack.Push(cmplx.Conj(c))
+	}
+
+	//C Returns the phase (argument) of a complex number in radians.
+	ops["math:phase"] = func() {
+		val := ValueStack.Pop("complexNumber")
+		if !loop {
+			return
+		}
+		c, ok := toComplex(val)
+		if !ok {
+			GfError("'math:phase' requires a numeric argument, not '%v' [%t]", val, val)
+			return
+		}
+		ValueStack.Push(cmplx.Phase(c))
+	}
+
+	//C Force convert the value on the top of stack into a complex number.
+	//C Example: "1+2i" complex! -> (1+2i)
+	ops["complex!"] = func() {
+		val := ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+		if str, ok := val.(string); ok {
+			c, err := strconv.ParseComplex(strings.TrimSpace(str), 128)
+			if err != nil {
+				GfError("%v", err)
+				return
+			}
+			ValueStack.Push(c)
+			return
+		}
+		c, ok := toComplex(val)
+		if !ok {
+			GfError("can't convert '%v' of type %t to complex.", val, val)
+			return
+		}
+		ValueStack.Push(c)
+	}
+
+	//C 2 6 .. -> [2 3 4 5 6]
+	//C Takes two values and generates a list from start to finish.
+	ops[".."] = func() {
+		v2 := ValueStack.Pop("operand2")
+		v1 := ValueStack.Pop("operand1")
+		if !loop {
+			return
+		}
+		switch v1 := v1.(type) {
+		case int:
+			switch v2 := v2.(type) {
+			case int:
+				incr := 1
+				if v1 > v2 {
+					incr = -1
+				}
+				size := int(math.Abs(float64(v1) - float64(v2)))
+				result := make([]interface{}, 0, size)
+				result = append(result, v1)
+				for v1 != v2 {
+					v1 += incr
+					result = append(result, v1)
 				}
 				ValueStack.Push(result)
+				return
 			default:
-				ValueStack.Push(append(result, v2))
+				GfError("two integer arguments are required")
 			}
+		default:
+			GfError("two integer arguments are required")
 		}
 	}
 
-	//C 1 [2 3 4] cons -> [1 2 3 4]
-	//C Adds the second element on the stack to the front of the list. 'cons' is
-	//C the dual of 'uncons'
-	ops["cons"] = func() {
-		v2 := ValueStack.Pop("list")
-		v1 := ValueStack.Pop("valToCons")
+	//C 1 1000000 seq:range -> <seq>
+	//C Lazy version of '..'. Returns a sequence of the integers from start to finish
+	//C that is only computed as it is consumed.
+	//C Example: 1 1000000 seq:range {2 *} map 3 take realize -> [2 4 6]
+	ops["seq:range"] = func() {
+		v2 := ValueStack.Pop("finish")
+		v1 := ValueStack.Pop("start")
 		if !loop {
 			return
 		}
-		switch v2 := v2.(type) {
-		case []interface{}:
-			v2 = append(v2, 0)
-			copy(v2[1:], v2)
-			v2[0] = v1
-			ValueStack.Push(v2)
-		default:
-			GfError("the second argument to cons must be a list, not [%t]", v2)
+		start, ok1 := v1.(int)
+		finish, ok2 := v2.(int)
+		if !ok1 || !ok2 {
+			GfError("two integer arguments are required")
+			return
+		}
+		incr := 1
+		if start > finish {
+			incr = -1
 		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			current := start
+			done := false
+			return &SeqIter{Next: func() (interface{}, bool) {
+				if done {
+					return nil, false
+				}
+				val := current
+				if current == finish {
+					done = true
+				} else {
+					current += incr
+				}
+				return val, true
+			}}
+		}})
 	}
 
-	//C <list> {<prog>} split -> <resultList1 resultList2
-	//C The 'split' function splits a list to pieces. If it is passed a prog, then
-	//C the list split base on the results of the prog applied to each element
-	//C Example: [1 2 3 4 5 6] {2 % 0 ==} list:split -> [1 3 5] [2 4 6]
-	//C Alternate use:
-	//C <list> <number> split -> <partition1> <partition2> ... <partitionN>
-	//C This function can also be used to partition a list into <number> length pieces.
-	//C Example: [1 2 3 4 5 6] 2 list:split -> [1 2] [3 4] [5 6]
-	ops["list:split"] = func() {
-		v2 := ValueStack.Pop("progOrValue")
-		v1 := ValueStack.Pop("listToSplit")
+	//C 1 seq:from -> <seq>
+	//C Returns the infinite sequence of numbers counting up from start.
+	//C Example: 1 seq:from {dup *} map 4 take realize -> [1 4 9 16]
+	ops["seq:from"] = func() {
+		start := ValueStack.Pop("start")
 		if !loop {
 			return
 		}
+		if numericRank(start) == rankNone || numericRank(start) == rankComplex {
+			GfError("the argument to 'seq:from' must be a real number, not %v", start)
+			return
+		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			current := start
+			return &SeqIter{Next: func() (interface{}, bool) {
+				val := current
+				current = nextValue(current)
+				return val, true
+			}}
+		}})
+	}
 
-		smaller := make([]interface{}, 0)
-		larger := make([]interface{}, 0)
-
-		switch x := v1.(type) {
-		case []interface{}:
-			switch y := v2.(type) {
-			case op:
-				for _, v := range x {
-					ValueStack.Push(v)
-					y.fn()
-					cond := ValueStack.Pop("progResult")
-					switch cond := cond.(type) {
-					case bool:
-						if cond {
-							larger = append(larger, v)
-						} else {
-							smaller = append(smaller, v)
-						}
-					default:
-						GfError("condition expression should return a boolean, not '%s' [%t]", cond, cond)
-					}
-				}
-				ValueStack.Push(smaller)
-				ValueStack.Push(larger)
-			case func():
-				for _, v := range x {
-					ValueStack.Push(v)
-					y()
-					cond := ValueStack.Pop("progResult")
-					switch cond := cond.(type) {
-					case bool:
-						if cond {
-							larger = append(larger, v)
-						} else {
-							smaller = append(smaller, v)
-						}
-					default:
-						GfError("condition expression should return a boolean, not '%s' [%t]", cond, cond)
+	//C <init> {prog} iterate -> <seq>
+	//C Returns the infinite sequence init, prog(init), prog(prog(init)), ...
+	//C Example: 1 {2 *} iterate 5 take realize -> [1 2 4 8 16]
+	ops["iterate"] = func() {
+		progVal := ValueStack.Pop("program")
+		init := ValueStack.Pop("initialValue")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("invalid prog argument, please provide a lambda, not %t", progVal)
+			return
+		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			current := init
+			started := false
+			return &SeqIter{Next: func() (interface{}, bool) {
+				if started {
+					ValueStack.Push(current)
+					prog()
+					current = ValueStack.Pop("progResult")
+					if !loop {
+						return nil, false
 					}
 				}
-				ValueStack.Push(smaller)
-				ValueStack.Push(larger)
-			case int:
-				all := make([]interface{}, 0)
-				curr := make([]interface{}, 0, y)
-				for _, v := range x {
-					if len(curr) > 0 && len(curr)%y == 0 {
-						all = append(all, curr)
-						curr = make([]interface{}, 0, y)
-						curr = append(curr, v)
+				started = true
+				return current, true
+			}}
+		}})
+	}
 
-					} else {
-						curr = append(curr, v)
-					}
+	//C <list> cycle -> <seq>
+	//C Returns an infinite sequence that repeats the elements of a list or sequence.
+	//C Example: [1 2] cycle 5 take realize -> [1 2 1 2 1]
+	ops["cycle"] = func() {
+		val := ValueStack.Pop("list")
+		if !loop {
+			return
+		}
+		seq, ok := toSeq(val)
+		if !ok {
+			GfError("the argument to 'cycle' must be a list or sequence, not %v", reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			src := seq.Iter()
+			empty := true
+			iter := &SeqIter{}
+			iter.Stop = func() { src.Close() }
+			iter.Next = func() (interface{}, bool) {
+				val, ok := src.Next()
+				if ok {
+					empty = false
+					return val, true
 				}
-				if len(curr) > 0 {
-					all = append(all, curr)
+				src.Close()
+				if empty || !loop {
+					return nil, false
 				}
-				ValueStack.Push(all)
-
-			default:
-				GfError("expression argument should be a lambda, not '%s' [%t]", y, y)
+				src = seq.Iter()
+				empty = true
+				return iter.Next()
 			}
-		default:
-			GfError("the first argument must be a list ([]interface{}), not '%v' [%t]", x, x)
-		}
+			return iter
+		}})
 	}
 
-	//C Polymorphic function that tests to see if the stack is a truthy false.
-	ops["false?"] = func() {
-		v1 := ValueStack.Pop("valToTest")
+	//C {prog} repeatedly -> <seq>
+	//C Returns an infinite sequence of the results of calling prog over and over.
+	//C Example: {10 random} repeatedly 3 take realize -> [7 1 4]
+	ops["repeatedly"] = func() {
+		progVal := ValueStack.Pop("program")
 		if !loop {
 			return
 		}
-		ValueStack.Push(isFalse(v1))
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("invalid prog argument, please provide a lambda, not %t", progVal)
+			return
+		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			return &SeqIter{Next: func() (interface{}, bool) {
+				prog()
+				val := ValueStack.Pop("progResult")
+				return val, loop
+			}}
+		}})
 	}
 
-	//C Polymorphic function that tests to see if the stack is a truthy true.
-	ops["true?"] = func() {
-		v1 := ValueStack.Pop("valToTest")
-		if !loop {
+	//C tok:next -> <value>
+	//C Used inside a MACRO to read the next token from the code being compiled.
+	//C Words are returned as symbols, literals as values and a {...} block as a
+	//C compiled quotation.
+	ops["tok:next"] = func() {
+		ctx := currentCompileContext()
+		if ctx == nil {
 			return
 		}
-		ValueStack.Push(isTrue(v1))
+		val := ctx.readToken(true)
+		if loop {
+			ValueStack.Push(val)
+		}
 	}
 
-	//C <value> true! -> true
-	//C Replaces the top of with the value true. This function is equivalent to
-	//C pop true
-	ops["true!"] = func() {
-		ValueStack.Pop("valToConvert")
+	//C tok:peek -> <value>
+	//C Used inside a MACRO to look at the next token without consuming it.
+	ops["tok:peek"] = func() {
+		ctx := currentCompileContext()
+		if ctx == nil {
+			return
+		}
+		if ctx.index >= len(ctx.fields) {
+			ValueStack.Push(nil)
+			return
+		}
+		val := ctx.readToken(false)
+		if loop {
+			ValueStack.Push(val)
+		}
+	}
+
+	//C <value> emit
+	//C Used inside a MACRO to add code to the function being compiled. A symbol is
+	//C compiled as a call to that word, a list is compiled as code and any other
+	//C value, including a block, is compiled as a literal.
+	//C Example: MACRO square == [:dup :*] emit ;
+	ops["emit"] = func() {
+		val := ValueStack.Pop("valueToEmit")
 		if !loop {
 			return
 		}
-		ValueStack.Push(true)
+		ctx := currentCompileContext()
+		if ctx == nil {
+			return
+		}
+		ctx.emit(val, activeFunction.tok)
 	}
 
-	//C <val> <number> * -> <multiplyResult>
-	//C The '*' function multiplies it's two arguments. It works for numbers
-	//C strings, and lists:
-	//C Example: 2 3 * -> 6
-	//C Example: "ab" 3 * -> "ababab"
-	//C Example: [1 2 3] 2 * -> [1 2 3 1 2 3]
-	ops["*"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
-		switch x := v1.(type) {
-		case int:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x * y)
-			case float64:
-				ValueStack.Push(float64(x) * y)
-			default:
-				GfError("Cannot multiply '%s' and '%s'", v1, v2)
-			}
-		case float64:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x * float64(y))
-			case float64:
-				ValueStack.Push(x * y)
-			default:
-				GfError("Cannot multiply '%s' and '%s'", v1, v2)
-			}
-		case string:
-			switch y := v2.(type) {
-			case int:
-				rstr := ""
-				for i := 0; i < y; i++ {
-					rstr += x
-				}
-				ValueStack.Push(rstr)
-			default:
-				GfError("Cannot multiply '%s' and '%s'", v1, v2)
-			}
-		case []interface{}:
-			switch y := v2.(type) {
-			case int:
-				result := make([]interface{}, 0, len(x)*y)
-				for i := 0; i < y; i++ {
-					result = append(result, x)
-				}
-				ValueStack.Push(result)
-			default:
-				GfError("Cannot multiply '%s' and '%s'", v1, v2)
-			}
-		default:
-			GfError("Cannot multiply '%s' and '%s'", v1, v2)
+	//C {prog} quote>list -> <list>
+	//C Turns a block into a list so it can be inspected and manipulated as data.
+	//C Words become symbols, literals become values and nested blocks become nested
+	//C lists. A literal symbol :x becomes "x" :symbol! so it means the same thing.
+	//C Example: {1 2 + dup *} quote>list -> [1 2 :+ :dup :*]
+	ops["quote>list"] = func() {
+		val := ValueStack.Pop("quote")
+		if !loop {
+			return
+		}
+		q, ok := val.(op)
+		if !ok {
+			GfError("'quote>list' requires a block argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		if q.code == nil {
+			GfError("the source of this function is not available")
+			return
+		}
+		result := quoteToList(q.code)
+		if !loop {
+			return
 		}
+		ValueStack.Push(result)
 	}
 
-	//C <val> <number> '-' -> <difference>
-	//C The '-' (subtraction) function subtracts the second value
-	//C from the first. It works on number, strings and lists:
-	//C 5 2 - -> 3
-	//C "abcde" 2 - -> "cde"
-	//C "[1 2 3 4 5] 2 - -> [3 4 5]
-	ops["-"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
+	//C <list> list>quote -> {prog}
+	//C Compiles a list into a runnable block. Symbols are compiled as words, nested
+	//C lists become nested blocks and all other values are pushed as they are.
+	//C Example: [1 2 :+] list>quote & -> 3
+	ops["list>quote"] = func() {
+		val := ValueStack.Pop("list")
 		if !loop {
 			return
 		}
-		switch x := v1.(type) {
-		case int:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x - int(y))
-			case float64:
-				ValueStack.Push(float64(x) - y)
-			default:
-				GfError("Can't subtract a value of type [%t] from an integer.")
-			}
-		case float64:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x - float64(y))
-			case float64:
-				ValueStack.Push(x - y)
-			default:
-				GfError("Can't subtract a value of type [%t] from a floating point number.")
-			}
-		case string:
-			switch y := v2.(type) {
-			case int:
-				if y < 0 {
-					y = len(x) + y
-				}
-				if y <= len(x) {
-					ValueStack.Push(string(x[y:]))
-				} else {
-					ValueStack.Push("")
-				}
-			case float64:
-				var i int
-				if y < 0 {
-					i = len(x) + int(y)
-				} else {
-					i = int(y)
-				}
-				if i <= len(x) {
-					ValueStack.Push(string(x[i:]))
-				} else {
-					ValueStack.Push("")
-				}
-			case string:
-				start := strings.Index(x, y)
-				if start > -1 {
-					ValueStack.Push(string(x[0:start]) + string(x[start+len(y):]))
-				}
-			default:
-				GfError("Can't subtract a value of type [%t] from a string.")
-			}
-		case []interface{}:
-			switch y := v2.(type) {
-			case int:
-				if y < 0 {
-					y = len(x) + y
-				}
-				if y <= len(x) {
-					ValueStack.Push((x[y:]))
-				} else {
-					ValueStack.Push(nil)
-				}
-			case float64:
-				var i int
-				if y < 0 {
-					i = len(x) + int(y)
-				} else {
-					i = int(y)
-				}
-				if i <= len(x) {
-					ValueStack.Push(x[i:])
-				} else {
-					ValueStack.Push(nil)
-				}
-			default:
-				GfError("Can't subtract a value of type [%t] from a list.")
-			}
+		items, ok := listItems(val)
+		if !ok {
+			GfError("'list>quote' requires a list argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		tok := activeFunction.tok
+		code := listToTokens(items, tok)
+		body := compileUnit(code)
+		if !loop {
+			return
+		}
+		ValueStack.Push(op{fn: func() { Eval(body) }, tok: tok, code: code})
+	}
 
-		default:
-			GfError("Cannot subtract %s [%t] and %s [%t]", v1, v1, v2, v2)
+	//C {prog} generator -> <seq>
+	//C Turns a block into a lazy sequence. The block runs as a coroutine with its own
+	//C stack and each call to 'yield' in the block produces the next element of the
+	//C sequence. The block only runs as far as needed to produce the elements that
+	//C are consumed. Variables visible where the generator was created can be read
+	//C from the block.
+	//C Example: {1 -> n {true} {n yield n 2 * -> n} while} generator 5 take realize -> [1 2 4 8 16]
+	ops["generator"] = func() {
+		progVal := ValueStack.Pop("program")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("invalid prog argument, please provide a lambda, not %t", progVal)
+			return
 		}
+		scope := VariableTable
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			g := newGenerator(prog, scope)
+			return &SeqIter{Next: g.Next, Stop: g.Stop}
+		}})
 	}
 
-	//C Divides two numbers. Integers and floats can be freely mixed.
-	ops["/"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
+	//C <value> yield ->
+	//C Hands a value to the consumer of the enclosing generator and suspends the
+	//C generator until the next value is needed. See also 'generator'.
+	ops["yield"] = func() {
+		val := ValueStack.Pop("valueToYield")
 		if !loop {
 			return
 		}
-		switch x := v1.(type) {
-		case int:
-			switch y := v2.(type) {
-			case int:
-				if y == 0 {
-					GfError("division by zero.")
-					return
-				}
-				ValueStack.Push(x / y)
-			case float64:
-				if y == 0 {
-					GfError("division by zero.")
-					return
-				}
-				ValueStack.Push(x / int(y))
-			}
-		case float64:
-			switch y := v2.(type) {
-			case int:
-				if y == 0 {
-					GfError("division by zero.")
-					return
-				}
-				ValueStack.Push(int(x) / y)
-			case float64:
-				if y == 0 {
-					GfError("division by zero.")
-					return
-				}
-				ValueStack.Push(x / y)
-			}
-		default:
-			GfError("Cannot divide %s by %s", v1, v2)
+		if currentGenerator == nil {
+			GfError("'yield' can only be used inside a generator block")
+			return
 		}
+		currentGenerator.yield(val)
 	}
 
-	//C '%' computes the modulus of two numbers
-	//C Example: 10 3 % -> 1
-	ops["%"] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
+	//C <seq> seq:iter -> <iterator>
+	//C Starts a pass over a sequence or list for consumers that pull values one at a
+	//C time with 'seq:next', for example in a 'while' loop. Call 'seq:stop' to end the
+	//C pass early.
+	//C Example: gen seq:iter -> it {it seq:next} {.} while
+	ops["seq:iter"] = func() {
+		val := ValueStack.Pop("seq")
 		if !loop {
 			return
 		}
-		switch x := v1.(type) {
-		case int:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(x % y)
-			case float64:
-				ValueStack.Push(x % int(y))
-			default:
-				GfError("Cannot use % with operands %s and %s", v1, v2)
-			}
-		case float64:
-			switch y := v2.(type) {
-			case int:
-				ValueStack.Push(int(x) % y)
-			case float64:
-				ValueStack.Push(int(x) % int(y))
-			default:
-				GfError("Cannot use % with operands %s and %s", v1, v2)
-			}
-		default:
-			GfError("Cannot use % with operands %s and %s", v1, v2)
+		seq, ok := toSeq(val)
+		if !ok {
+			GfError("only a list or sequence can be iterated, not %v", reflect.TypeOf(val))
+			return
 		}
+		ValueStack.Push(seq.Iter())
 	}
 
-	//C 2 6 .. -> [2 3 4 5 6]
-	//C Takes two values and generates a list from start to finish.
-	ops[".."] = func() {
-		v2 := ValueStack.Pop("operand2")
-		v1 := ValueStack.Pop("operand1")
+	//C <iterator> seq:next -> <value> true | false
+	//C Gets the next value from an iterator created by 'seq:iter'. Pushes the value
+	//C and true, or just false when there are no more values.
+	ops["seq:next"] = func() {
+		val := ValueStack.Pop("iterator")
 		if !loop {
 			return
 		}
-		switch v1 := v1.(type) {
-		case int:
-			switch v2 := v2.(type) {
-			case int:
-				incr := 1
-				if v1 > v2 {
-					incr = -1
-				}
-				size := int(math.Abs(float64(v1) - float64(v2)))
-				result := make([]interface{}, 0, size)
-				result = append(result, v1)
-				for v1 != v2 {
-					v1 += incr
-					result = append(result, v1)
-				}
-				ValueStack.Push(result)
-				return
-			default:
-				GfError("two integer arguments are required")
-			}
+		it, ok := val.(*SeqIter)
+		if !ok {
+			GfError("the argument to 'seq:next' must be an iterator, not %v", reflect.TypeOf(val))
+			return
+		}
+		next, more := it.Next()
+		if !loop {
+			return
+		}
+		if more {
+			ValueStack.Push(next)
+		} else {
+			it.Close()
+		}
+		ValueStack.Push(more)
+	}
+
+	//C <iterator> seq:stop ->
+	//C Ends a pass over a sequence started with 'seq:iter', releasing any resources
+	//C like open files or suspended generators.
+	ops["seq:stop"] = func() {
+		val := ValueStack.Pop("iterator")
+		if !loop {
+			return
+		}
+		it, ok := val.(*SeqIter)
+		if !ok {
+			GfError("the argument to 'seq:stop' must be an iterator, not %v", reflect.TypeOf(val))
+			return
+		}
+		it.Close()
+	}
+
+	//C <seq> realize -> <list>
+	//C Computes all of the elements of a lazy sequence and returns them as a list.
+	//C Other values are returned unchanged.
+	ops["realize"] = func() {
+		val := ValueStack.Pop("seq")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Seq:
+			ValueStack.Push(val.Realize())
 		default:
-			GfError("two integer arguments are required")
+			ValueStack.Push(val)
+		}
+	}
+
+	//C <list> seq! -> <seq>
+	//C Turns a list, vector or plist into a lazy sequence so that 'map', 'filter',
+	//C 'take' and 'skip' over it don't build intermediate lists.
+	ops["seq!"] = func() {
+		val := ValueStack.Pop("list")
+		if !loop {
+			return
 		}
+		seq, ok := toSeq(val)
+		if !ok {
+			GfError("only a list can be converted to a sequence, not %v", reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(seq)
 	}
 
 	//C 2 6 2 .. -> [2 4 6]
@@ -2417,6 +7253,94 @@ func main() {
 		}
 	}
 
+	//C <value> vector? -> <boolean>
+	//C Returns true if the value on the top of stack is a persistent vector.
+	ops["vector?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(*PVector)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> plist? -> <boolean>
+	//C Returns true if the value on the top of stack is a persistent list.
+	ops["plist?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(*PList)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> seq? -> <boolean>
+	//C Returns true if the value on the top of stack is a lazy sequence.
+	ops["seq?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(*Seq)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> bytes? -> <boolean>
+	//C Returns true if the value on the top of stack is a byte string.
+	ops["bytes?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(Bytes)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> time? -> <boolean>
+	//C Returns true if the value on the top of stack is a time.
+	ops["time?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(time.Time)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> duration? -> <boolean>
+	//C Returns true if the value on the top of stack is a duration.
+	ops["duration?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(time.Duration)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> symbol? -> <boolean>
+	//C Returns true if the value on the top of stack is a symbol like :name.
+	ops["symbol?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(*Symbol)
+		ValueStack.Push(ok)
+	}
+
+	//C <value> bitset? -> <boolean>
+	//C Returns true if the value on the top of stack is a set like #{1 2 3}.
+	ops["bitset?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		_, ok := val.(BitSet)
+		ValueStack.Push(ok)
+	}
+
 	//C <value> dict? -> <boolean>
 	//C Returns true if the value on the top of stack is a dictionary.
 	ops["dict?"] = func() {
@@ -2425,7 +7349,7 @@ func main() {
 			return
 		}
 		switch val.(type) {
-		case map[interface{}]interface{}:
+		case *Dict:
 			ValueStack.Push(true)
 		case map[string]interface{}:
 			ValueStack.Push(true)
@@ -2459,6 +7383,23 @@ func main() {
 		switch val.(type) {
 		case int:
 			ValueStack.Push(true)
+		case *big.Int:
+			ValueStack.Push(true)
+		default:
+			ValueStack.Push(false)
+		}
+	}
+
+	//C <value> big? -> <boolean>
+	//C Returns true if the value on the top of stack is an arbitrary-precision integer.
+	ops["big?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		switch val.(type) {
+		case *big.Int:
+			ValueStack.Push(true)
 		default:
 			ValueStack.Push(false)
 		}
@@ -2479,6 +7420,51 @@ func main() {
 		}
 	}
 
+	//C <value> rat? -> <boolean>
+	//C Returns true if the value on the top of stack is an exact rational number.
+	ops["rat?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		switch val.(type) {
+		case *big.Rat:
+			ValueStack.Push(true)
+		default:
+			ValueStack.Push(false)
+		}
+	}
+
+	//C <value> dec? -> <boolean>
+	//C Returns true if the value on the top of stack is a fixed-scale decimal.
+	ops["dec?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		switch val.(type) {
+		case Decimal:
+			ValueStack.Push(true)
+		default:
+			ValueStack.Push(false)
+		}
+	}
+
+	//C <value> complex? -> <boolean>
+	//C Returns true if the value on the top of stack is a complex number.
+	ops["complex?"] = func() {
+		val := ValueStack.Pop("valToTest")
+		if !loop {
+			return
+		}
+		switch val.(type) {
+		case complex128:
+			ValueStack.Push(true)
+		default:
+			ValueStack.Push(false)
+		}
+	}
+
 	//C <value> byte? -> <boolean>
 	//C Returns true if the value on the top of stack is a byte.
 	ops["byte?"] = func() {
@@ -2495,7 +7481,7 @@ func main() {
 	}
 
 	//C <value> number? -> <boolean>
-	//C Returns true if the value on the top of stack is a number (float or int).
+	//C Returns true if the value on the top of stack is a number (float, int, big, rat, dec or complex).
 	ops["number?"] = func() {
 		val := ValueStack.Pop("valToTest")
 		if !loop {
@@ -2506,6 +7492,14 @@ func main() {
 			ValueStack.Push(true)
 		case int:
 			ValueStack.Push(true)
+		case *big.Int:
+			ValueStack.Push(true)
+		case *big.Rat:
+			ValueStack.Push(true)
+		case Decimal:
+			ValueStack.Push(true)
+		case complex128:
+			ValueStack.Push(true)
 		case byte:
 			ValueStack.Push(true)
 		default:
@@ -2513,20 +7507,6 @@ func main() {
 		}
 	}
 
-	//C 1 2 3 rol -> 3 1 2
-	//C Roll the top three elements on the stack by one place
-	ops["rol"] = func() {
-		tos := ValueStack.Pop("tos")
-		v2 := ValueStack.Pop("v2")
-		v1 := ValueStack.Pop("v1")
-		if !loop {
-			return
-		}
-		ValueStack.Push(tos)
-		ValueStack.Push(v1)
-		ValueStack.Push(v2)
-	}
-
 	//C X Y swap -> Y X
 	//C Swap the top two elements on the stack.
 	ops["swap"] = func() {
@@ -2558,19 +7538,9 @@ func main() {
 		}
 	}
 
-	//C X Y popd -> Y
-	//C Pop the TOS-1 element off the stack and discard it.
-	ops["popd"] = func() {
-		if ValueStack.index > 1 {
-			ValueStack.Value[ValueStack.index-2] = ValueStack.Value[ValueStack.index-1]
-			ValueStack.index--
-		} else {
-			GfError("there must be at least 2 values on the stack to call 'popd'.")
-		}
-	}
-
-	//C Returns true if the top value on the stack is small i.e. a list or string
-	//C with length less than 2, an integer or float less than 2, nil or a boolean value.
+	//C Returns true if the top value on the stack is small i.e. a list, vector, plist,
+	//C sequence, byte string or string with fewer than 2 elements, an integer or
+	//C float less than 2, nil or a boolean value.
 	ops["small"] = func() {
 		index := ValueStack.index
 		if index < 1 {
@@ -2580,10 +7550,25 @@ func main() {
 		switch val := ValueStack.Value[index-1].(type) {
 		case []interface{}:
 			ValueStack.Value[index-1] = len(val) < 2
-		case string:
+		case *PVector:
+			ValueStack.Value[index-1] = val.Len() < 2
+		case *PList:
+			ValueStack.Value[index-1] = val.Len() < 2
+		case Bytes:
 			ValueStack.Value[index-1] = len(val) < 2
+		case *Seq:
+			count := 0
+			val.Each(func(interface{}) bool {
+				count++
+				return count < 2
+			})
+			ValueStack.Value[index-1] = count < 2
+		case string:
+			ValueStack.Value[index-1] = utf8.RuneCountInString(val) < 2
 		case int:
 			ValueStack.Value[index-1] = val < 2
+		case *big.Int:
+			ValueStack.Value[index-1] = val.Sign() < 0
 		case float64:
 			ValueStack.Value[index-1] = val < 2
 		case nil:
@@ -2593,72 +7578,314 @@ func main() {
 		}
 	}
 
-	//C Clear the stack.
-	ops["cstk"] = func() { ValueStack.Reset() }
+	//C Clear the stack.
+	ops["cstk"] = func() { ValueStack.Reset() }
+
+	//C X Y dup -> X Y Y
+	//C Duplicate the top element on the stack
+	ops["dup"] = func() {
+		index := ValueStack.index
+		if index > 0 {
+			ValueStack.Value[index] = ValueStack.Value[index-1]
+			ValueStack.index++
+		} else {
+			GfError("there must be at least 1 value on the stack to call 'dup'.")
+		}
+	}
+
+	//C X Y nip -> Y
+	//C Drops the second element on the stack.
+	ops["nip"] = func() {
+		vals, ok := popValues("x", "y")
+		if ok {
+			pushValues(vals[1])
+		}
+	}
+
+	//C X Y popd -> Y
+	//C Drops the second element on the stack. The same as 'nip'.
+	ops["popd"] = ops["nip"]
+
+	//C X Y tuck -> Y X Y
+	//C Copies the top element under the second one.
+	ops["tuck"] = func() {
+		vals, ok := popValues("x", "y")
+		if ok {
+			pushValues(vals[1], vals[0], vals[1])
+		}
+	}
+
+	//C X Y dupd -> X X Y
+	//C Duplicates the second element on the stack.
+	ops["dupd"] = func() {
+		vals, ok := popValues("x", "y")
+		if ok {
+			pushValues(vals[0], vals[0], vals[1])
+		}
+	}
+
+	//C X Y Z rot -> Y Z X
+	//C Rotates the third element to the top of the stack.
+	ops["rot"] = func() {
+		vals, ok := popValues("x", "y", "z")
+		if ok {
+			pushValues(vals[1], vals[2], vals[0])
+		}
+	}
+
+	//C X Y Z -rot -> Z X Y
+	//C Rotates the top element down to third place.
+	ops["-rot"] = func() {
+		vals, ok := popValues("x", "y", "z")
+		if ok {
+			pushValues(vals[2], vals[0], vals[1])
+		}
+	}
+
+	//C 1 2 3 rol -> 3 1 2
+	//C Roll the top three elements on the stack by one place. The same as '-rot'.
+	ops["rol"] = ops["-rot"]
+
+	//C Xn ... X0 n pick -> Xn ... X0 Xn
+	//C Copies the nth element, counting from 0 at the top, to the top of the stack.
+	//C Example: 1 2 3 2 pick -> 1 2 3 1
+	ops["pick"] = func() {
+		n, ok := stackDepthArg("pick", 1)
+		if ok {
+			ValueStack.Push(ValueStack.Value[ValueStack.index-1-n])
+		}
+	}
+
+	//C Xn ... X0 n roll -> Xn-1 ... X0 Xn
+	//C Moves the nth element, counting from 0 at the top, to the top of the stack.
+	//C Example: 1 2 3 2 roll -> 2 3 1
+	ops["roll"] = func() {
+		n, ok := stackDepthArg("roll", 1)
+		if !ok {
+			return
+		}
+		top := ValueStack.index - 1
+		val := ValueStack.Value[top-n]
+		copy(ValueStack.Value[top-n:top], ValueStack.Value[top-n+1:top+1])
+		ValueStack.Value[top] = val
+	}
+
+	//C A B 2dup -> A B A B
+	//C Duplicates the top 2 elements on the stack.
+	ops["2dup"] = func() {
+		vals, ok := popValues("a", "b")
+		if ok {
+			pushValues(vals[0], vals[1], vals[0], vals[1])
+		}
+	}
+
+	//C 1 2 3 4 dup2 -> 1 2 3 4 3 4
+	//C Duplicate the top 2 elements on the stack. The same as '2dup'.
+	ops["dup2"] = ops["2dup"]
+
+	//C A B 2drop ->
+	//C Drops the top 2 elements on the stack.
+	ops["2drop"] = func() {
+		popValues("a", "b")
+	}
+
+	//C A B C D 2swap -> C D A B
+	//C Swaps the top two pairs of elements on the stack.
+	ops["2swap"] = func() {
+		vals, ok := popValues("a", "b", "c", "d")
+		if ok {
+			pushValues(vals[2], vals[3], vals[0], vals[1])
+		}
+	}
+
+	//C A B C D 2over -> A B C D A B
+	//C Copies the second pair of elements on the stack to the top.
+	ops["2over"] = func() {
+		vals, ok := popValues("a", "b", "c", "d")
+		if ok {
+			pushValues(vals[0], vals[1], vals[2], vals[3], vals[0], vals[1])
+		}
+	}
+
+	//C A B C D 2nip -> C D
+	//C Drops the second pair of elements on the stack.
+	ops["2nip"] = func() {
+		vals, ok := popValues("a", "b", "c", "d")
+		if ok {
+			pushValues(vals[2], vals[3])
+		}
+	}
 
-	//C X Y dup -> X Y Y
-	//C Duplicate the top element on the stack
-	ops["dup"] = func() {
-		index := ValueStack.index
-		if index > 0 {
-			ValueStack.Value[index] = ValueStack.Value[index-1]
-			ValueStack.index++
-		} else {
-			GfError("there must be at least 1 value on the stack to call 'dup'.")
+	//C X {P} keep -> P(X) X
+	//C Runs the prog on the top element and then restores that element.
+	//C Example: 3 {dup *} keep -> 9 3
+	ops["keep"] = func() {
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		x := ValueStack.Pop("x")
+		if !loop {
+			return
 		}
+		ValueStack.Push(x)
+		progs[0]()
+		ValueStack.Push(x)
 	}
 
-	//C 1 2 3 4 dup2 -> 1 2 3 4 3 4
-	//C Duplicate the top 2 elements on the stack.
-	ops["dup2"] = func() {
-		index := ValueStack.index
-		if index > 1 {
-			ValueStack.Value[index+1], ValueStack.Value[index] = ValueStack.Value[index-1], ValueStack.Value[index-2]
-			ValueStack.index += 2
-		} else {
-			GfError("there must be at least 2 values on the stack to call 'dup2'.")
+	//C X Y {P} 2keep -> P(X Y) X Y
+	//C Runs the prog on the top two elements and then restores them.
+	//C Example: 3 4 {+} 2keep -> 7 3 4
+	ops["2keep"] = func() {
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		vals, ok := popValues("x", "y")
+		if !ok {
+			return
+		}
+		pushValues(vals...)
+		progs[0]()
+		pushValues(vals...)
+	}
+
+	//C X {P} {Q} bi -> P(X) Q(X)
+	//C Applies two progs to the same value.
+	//C Example: 5 {1 +} {1 -} bi -> 6 4
+	ops["bi"] = func() {
+		progs, ok := popProgs("first", "second")
+		if !ok {
+			return
+		}
+		x := ValueStack.Pop("x")
+		if !loop {
+			return
+		}
+		for _, prog := range progs {
+			ValueStack.Push(x)
+			prog()
+			if !loop {
+				return
+			}
 		}
 	}
 
 	//C X {P1} {P2} cleave -> R1 R2
-	//C Executes P1 and P2, each with X on top, producing two results.
-	ops["cleave"] = func() {
-		prog2val := ValueStack.Pop("prog2val")
-		prog1val := ValueStack.Pop("prog1val")
-		val := ValueStack.Pop("valToPrint")
+	//C Executes P1 and P2, each with X on top, producing two results. The same as 'bi'.
+	ops["cleave"] = ops["bi"]
+
+	//C X {P} {Q} {R} tri -> P(X) Q(X) R(X)
+	//C Applies three progs to the same value.
+	//C Example: 5 {1 +} {1 -} {2 *} tri -> 6 4 10
+	ops["tri"] = func() {
+		progs, ok := popProgs("first", "second", "third")
+		if !ok {
+			return
+		}
+		x := ValueStack.Pop("x")
 		if !loop {
 			return
 		}
+		for _, prog := range progs {
+			ValueStack.Push(x)
+			prog()
+			if !loop {
+				return
+			}
+		}
+	}
+
+	//C X Y {P} {Q} bi* -> P(X) Q(Y)
+	//C Applies the first prog to X and the second to Y.
+	//C Example: 1 2 {10 +} {20 +} bi* -> 11 22
+	ops["bi*"] = func() {
+		progs, ok := popProgs("first", "second")
+		if ok {
+			spreadProgs(progs)
+		}
+	}
 
-		var prog1 func()
-		var prog2 func()
+	//C X Y Z {P} {Q} {R} tri* -> P(X) Q(Y) R(Z)
+	//C Applies each prog to the matching value.
+	//C Example: 1 2 3 {1 +} {2 +} {3 +} tri* -> 2 4 6
+	ops["tri*"] = func() {
+		progs, ok := popProgs("first", "second", "third")
+		if ok {
+			spreadProgs(progs)
+		}
+	}
 
-		switch prog1val := prog1val.(type) {
-		case op:
-			prog1 = prog1val.fn
-		case func():
-			prog1 = prog1val
-		default:
-			GfError("the third argument to 'cleave' must be a prog")
+	//C X Y {P} bi@ -> P(X) P(Y)
+	//C Applies the prog to each of the top two values.
+	//C Example: 2 3 {dup *} bi@ -> 4 9
+	ops["bi@"] = func() {
+		progs, ok := popProgs("prog")
+		if ok {
+			spreadProgs([]func(){progs[0], progs[0]})
 		}
+	}
 
-		switch prog2val := prog2val.(type) {
-		case op:
-			prog2 = prog2val.fn
-		case func():
-			prog2 = prog2val
-		default:
-			GfError("the second argument to 'cleave' must be a prog")
+	//C 2 3 {2 *} apply2 -> 4 6
+	//C The 'apply2' function takes a prog and applies it to the top 2 elements on the stack.
+	//C The same as 'bi@'.
+	ops["apply2"] = ops["bi@"]
+
+	//C X Y Z {P} tri@ -> P(X) P(Y) P(Z)
+	//C Applies the prog to each of the top three values.
+	//C Example: 1 2 3 {10 *} tri@ -> 10 20 30
+	ops["tri@"] = func() {
+		progs, ok := popProgs("prog")
+		if ok {
+			spreadProgs([]func(){progs[0], progs[0], progs[0]})
 		}
+	}
 
+	//C 1 2 3 {2 *} apply3 -> 2 4 6
+	//C The 'apply3' function takes a prog and applies it to the top 3 elements on the stack.
+	//C The same as 'tri@'.
+	ops["apply3"] = ops["tri@"]
+
+	//C X1 ... Xn [{P1} ... {Pn}] spread -> P1(X1) ... Pn(Xn)
+	//C Applies each prog in the list to the matching value on the stack.
+	//C Example: 1 2 3 [{1 +} {2 *} {3 -}] spread -> 2 4 0
+	ops["spread"] = func() {
+		listVal := ValueStack.Pop("progs")
 		if !loop {
 			return
 		}
+		items, ok := listItems(listVal)
+		if !ok {
+			GfError("'spread' requires a list of lambdas, not '%v'", listVal)
+			return
+		}
+		progs := make([]func(), len(items))
+		for i, item := range items {
+			if progs[i], ok = progFunc(item); !ok {
+				GfError("'spread' requires a list of lambdas; '%v' isn't one", item)
+				return
+			}
+		}
+		spreadProgs(progs)
+	}
 
-		ValueStack.Push(val)
-		prog1()
-		ValueStack.Push(val)
-		prog2()
+	//C X1 ... Xn {P} n napply -> P(X1) ... P(Xn)
+	//C Applies the prog to each of the top n values on the stack.
+	//C Example: 1 2 3 4 {dup *} 3 napply -> 1 4 9 16
+	ops["napply"] = func() {
+		n, ok := stackDepthArg("napply", 1)
+		if !ok {
+			return
+		}
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		all := make([]func(), n)
+		for i := range all {
+			all[i] = progs[0]
+		}
+		spreadProgs(all)
 	}
 
 	//C Pop the top value off the stack and print it.
@@ -2797,7 +8024,7 @@ func main() {
 		ValueStack.Push(result)
 	}
 
-	//C Sleep for the specified number of milliseconds
+	//C Sleep for the specified number of milliseconds or for a duration like 1s
 	ops["sleep"] = func() {
 		duration := ValueStack.Pop("duration")
 		if !loop {
@@ -2807,8 +8034,10 @@ func main() {
 		switch duration := duration.(type) {
 		case int:
 			time.Sleep(time.Millisecond * time.Duration(duration))
+		case time.Duration:
+			time.Sleep(duration)
 		default:
-			GfError("The 'sleep' function requires an integer argument.")
+			GfError("The 'sleep' function requires an integer or duration argument.")
 		}
 	}
 
@@ -2846,6 +8075,232 @@ func main() {
 		}
 	}
 
+	//C <time> <layout> time:format -> <string>
+	//C Formats a time using a Go layout string like "2006-01-02 15:04" or one of the
+	//C named layouts RFC3339, RFC1123, ANSIC, UnixDate, Kitchen, DateTime, DateOnly or TimeOnly.
+	//C Example: datetime "DateOnly" time:format -> "2024-01-15"
+	ops["time:format"] = func() {
+		layout := ValueStack.Pop("layout")
+		val := ValueStack.Pop("time")
+		if !loop {
+			return
+		}
+		t, ok := val.(time.Time)
+		if !ok {
+			GfError("'time:format' requires a time argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(t.Format(timeLayout(fmt.Sprint(layout))))
+	}
+
+	//C <string> <layout> time:parse -> <time>
+	//C Parses a string into a time using a layout as described for 'time:format'.
+	//C Times without a zone are taken to be UTC.
+	//C Example: "2024-01-15 10:30:00" "DateTime" time:parse
+	ops["time:parse"] = func() {
+		layout := ValueStack.Pop("layout")
+		val := ValueStack.Pop("stringToParse")
+		if !loop {
+			return
+		}
+		str, ok := val.(string)
+		if !ok {
+			GfError("'time:parse' requires a string argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		t, err := time.Parse(timeLayout(fmt.Sprint(layout)), str)
+		if err != nil {
+			GfError("unable to parse time '%s': %s", str, err)
+			return
+		}
+		ValueStack.Push(t)
+	}
+
+	//C <year> <month> <day> time:date -> <time>
+	//C Creates a time at midnight UTC on the given date.
+	//C Example: 2024 1 15 time:date
+	ops["time:date"] = func() {
+		day := ValueStack.Pop("day")
+		month := ValueStack.Pop("month")
+		year := ValueStack.Pop("year")
+		if !loop {
+			return
+		}
+		y, ok1 := year.(int)
+		m, ok2 := month.(int)
+		d, ok3 := day.(int)
+		if !ok1 || !ok2 || !ok3 {
+			GfError("'time:date' requires integer year, month and day arguments")
+			return
+		}
+		ValueStack.Push(time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC))
+	}
+
+	//C <time> <duration> time:add -> <time>
+	//C Adds a duration to a time. The duration may be a duration value, a string like
+	//C "1h30m" or a number of seconds. '+' and '-' also work on times and durations.
+	//C Example: datetime 90m time:add
+	ops["time:add"] = func() {
+		durVal := ValueStack.Pop("duration")
+		val := ValueStack.Pop("time")
+		if !loop {
+			return
+		}
+		t, ok := val.(time.Time)
+		if !ok {
+			GfError("'time:add' requires a time argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		d, ok := toDuration(durVal)
+		if !ok {
+			GfError("'time:add' requires a duration, not '%v'", durVal)
+			return
+		}
+		ValueStack.Push(t.Add(d))
+	}
+
+	//C <time> <years> <months> <days> time:adddate -> <time>
+	//C Adds a number of years, months and days to a time.
+	//C Example: 2024 1 31 time:date 0 1 0 time:adddate -> 2024-03-02
+	ops["time:adddate"] = func() {
+		days := ValueStack.Pop("days")
+		months := ValueStack.Pop("months")
+		years := ValueStack.Pop("years")
+		val := ValueStack.Pop("time")
+		if !loop {
+			return
+		}
+		t, ok := val.(time.Time)
+		if !ok {
+			GfError("'time:adddate' requires a time argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		y, ok1 := years.(int)
+		m, ok2 := months.(int)
+		d, ok3 := days.(int)
+		if !ok1 || !ok2 || !ok3 {
+			GfError("'time:adddate' requires integer years, months and days")
+			return
+		}
+		ValueStack.Push(t.AddDate(y, m, d))
+	}
+
+	//C Get the year of a time.
+	ops["time:year"] = timeAccessor("time:year", func(t time.Time) interface{} { return t.Year() })
+
+	//C Get the month of a time as a number from 1 to 12.
+	ops["time:month"] = timeAccessor("time:month", func(t time.Time) interface{} { return int(t.Month()) })
+
+	//C Get the day of the month of a time.
+	ops["time:day"] = timeAccessor("time:day", func(t time.Time) interface{} { return t.Day() })
+
+	//C Get the hour of a time.
+	ops["time:hour"] = timeAccessor("time:hour", func(t time.Time) interface{} { return t.Hour() })
+
+	//C Get the minute of a time.
+	ops["time:minute"] = timeAccessor("time:minute", func(t time.Time) interface{} { return t.Minute() })
+
+	//C Get the second of a time.
+	ops["time:second"] = timeAccessor("time:second", func(t time.Time) interface{} { return t.Second() })
+
+	//C Get the nanosecond part of a time.
+	ops["time:nanosecond"] = timeAccessor("time:nanosecond", func(t time.Time) interface{} { return t.Nanosecond() })
+
+	//C Get the name of the day of the week of a time e.g. "Monday".
+	ops["time:weekday"] = timeAccessor("time:weekday", func(t time.Time) interface{} { return t.Weekday().String() })
+
+	//C Get the day of the year of a time, from 1 to 366.
+	ops["time:yearday"] = timeAccessor("time:yearday", func(t time.Time) interface{} { return t.YearDay() })
+
+	//C Get the name of the time zone of a time e.g. "UTC".
+	ops["time:zone"] = timeAccessor("time:zone", func(t time.Time) interface{} {
+		name, _ := t.Zone()
+		return name
+	})
+
+	//C Get a time as the number of seconds since January 1, 1970 UTC.
+	ops["time:unix"] = timeAccessor("time:unix", func(t time.Time) interface{} { return int(t.Unix()) })
+
+	//C Get a time as the number of milliseconds since January 1, 1970 UTC.
+	ops["time:unixmilli"] = timeAccessor("time:unixmilli", func(t time.Time) interface{} {
+		return int(t.UnixNano() / int64(time.Millisecond))
+	})
+
+	//C Convert a time to UTC.
+	ops["time:utc"] = timeAccessor("time:utc", func(t time.Time) interface{} { return t.UTC() })
+
+	//C Convert a time to the local time zone.
+	ops["time:local"] = timeAccessor("time:local", func(t time.Time) interface{} { return t.Local() })
+
+	//C <seconds> time:fromunix -> <time>
+	//C Converts a number of seconds since January 1, 1970 UTC into a time in UTC.
+	//C Example: 0 time:fromunix -> 1970-01-01 00:00:00 +0000 UTC
+	ops["time:fromunix"] = func() {
+		val := ValueStack.Pop("seconds")
+		if !loop {
+			return
+		}
+		switch secs := val.(type) {
+		case int:
+			ValueStack.Push(time.Unix(int64(secs), 0).UTC())
+		case float64:
+			whole := math.Floor(secs)
+			ValueStack.Push(time.Unix(int64(whole), int64((secs-whole)*1e9)).UTC())
+		default:
+			GfError("'time:fromunix' requires a number of seconds, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C <time> <zoneName> time:in -> <time>
+	//C Converts a time to the named IANA time zone e.g. "America/New_York".
+	ops["time:in"] = func() {
+		zone := ValueStack.Pop("zone")
+		val := ValueStack.Pop("time")
+		if !loop {
+			return
+		}
+		t, ok := val.(time.Time)
+		if !ok {
+			GfError("'time:in' requires a time argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		loc, err := time.LoadLocation(fmt.Sprint(zone))
+		if err != nil {
+			GfError("unknown time zone '%v': %s", zone, err)
+			return
+		}
+		ValueStack.Push(t.In(loc))
+	}
+
+	//C Converts a string like "1h30m", or a number of seconds, into a duration.
+	//C Durations can also be written as literals e.g. 5m30s or 250ms.
+	ops["duration!"] = func() {
+		val := ValueStack.Pop("valueToConvert")
+		if !loop {
+			return
+		}
+		d, ok := toDuration(val)
+		if !ok {
+			GfError("can't convert '%v' to a duration", val)
+			return
+		}
+		ValueStack.Push(d)
+	}
+
+	//C Get a duration as a floating point number of hours.
+	ops["duration:hours"] = durationAccessor("duration:hours", func(d time.Duration) interface{} { return d.Hours() })
+
+	//C Get a duration as a floating point number of minutes.
+	ops["duration:minutes"] = durationAccessor("duration:minutes", func(d time.Duration) interface{} { return d.Minutes() })
+
+	//C Get a duration as a floating point number of seconds.
+	ops["duration:seconds"] = durationAccessor("duration:seconds", func(d time.Duration) interface{} { return d.Seconds() })
+
+	//C Get a duration as an integer number of milliseconds.
+	ops["duration:ms"] = durationAccessor("duration:ms", func(d time.Duration) interface{} {
+		return int(d / time.Millisecond)
+	})
+
 	//C <collection> <index> @ -> <elementAtIndex>
 	//C Get the value from the collection indicated by index. Works for lists
 	//C and dictionaries.
@@ -2883,30 +8338,51 @@ func main() {
 					ValueStack.Push(x[idx])
 				}
 			}
-		case map[interface{}]interface{}:
-			ValueStack.Push(x[idxVal])
+		case *PVector:
+			if x.Len() == 0 {
+				ValueStack.Push(nil)
+			} else {
+				ValueStack.Push(x.Nth(clampIndex(idx, x.Len())))
+			}
+		case Bytes:
+			if len(x) == 0 {
+				ValueStack.Push(nil)
+			} else {
+				ValueStack.Push(int(x[clampIndex(idx, len(x))]))
+			}
+		case *PList:
+			if x.Len() == 0 {
+				ValueStack.Push(nil)
+			} else {
+				ValueStack.Push(x.Drop(clampIndex(idx, x.Len())).First())
+			}
+		case *Dict:
+			val, _ := x.Get(idxVal)
+			ValueStack.Push(val)
+		case *Record:
+			name := fmt.Sprint(idxVal)
+			if sym, ok := idxVal.(*Symbol); ok {
+				name = sym.Name
+			}
+			val, ok := x.Field(name)
+			if !ok {
+				GfError("record type '%s' has no field '%s'", x.Type.Name, name)
+				return
+			}
+			ValueStack.Push(val)
 		case map[string]interface{}:
 			idxStr := fmt.Sprintf("%v", idxVal)
+			if sym, ok := idxVal.(*Symbol); ok {
+				idxStr = sym.Name
+			}
 			ValueStack.Push(x[idxStr])
 		case string:
-			result := ""
-			if len(x) == 0 {
-				result = ""
-			} else if idx >= 0 {
-				if idx <= len(x) {
-					result = string(rune(x[idx]))
-				} else {
-					result = string(rune(x[len(x)-1]))
-				}
+			runes := []rune(x)
+			if len(runes) == 0 {
+				ValueStack.Push("")
 			} else {
-				idx = len(x) + idx
-				if idx < 0 {
-					result = string(rune(x[0]))
-				} else {
-					result = string(rune(x[idx]))
-				}
+				ValueStack.Push(string(runes[clampIndex(idx, len(runes))]))
 			}
-			ValueStack.Push(result)
 		default:
 			GfError("unable to index into a object of type %t using '%v'", x, idx)
 		}
@@ -2925,10 +8401,74 @@ func main() {
 		switch x := vect.(type) {
 		case []interface{}:
 			x[idx.(int)] = newVal
-		case map[interface{}]interface{}:
-			x[idx] = newVal
+		case *Dict:
+			x.Set(idx, newVal)
 		case map[string]interface{}:
-			x[idx.(string)] = newVal
+			switch key := idx.(type) {
+			case string:
+				x[key] = newVal
+			case *Symbol:
+				x[key.Name] = newVal
+			default:
+				GfError("the key for this dictionary must be a string or symbol, not '%v'", idx)
+			}
+		case *PVector, *PList:
+			GfError("vectors and plists are immutable; use 'assoc' to get an updated copy")
+		default:
+			GfError("unable to index into a object of type %t using '%s'", x, idx)
+		}
+	}
+
+	//C V I E assoc -> V2
+	//C The 'assoc' function returns a copy of the list, vector or dictionary V with
+	//C the element at index I set to E. The original value is not changed. Vectors
+	//C and plists share structure with the original so this is cheap.
+	//C Example: [1 2 3 4] vector! 1 20 assoc -> #[1 20 3 4]
+	ops["assoc"] = func() {
+		newVal := ValueStack.Pop("newval")
+		idx := ValueStack.Pop("index")
+		vect := ValueStack.Pop("vector")
+		if !loop {
+			return
+		}
+		switch x := vect.(type) {
+		case *Dict:
+			result := NewDict(x.Len() + 1)
+			for _, e := range x.Entries() {
+				result.Set(e.Key, e.Value)
+			}
+			result.Set(idx, newVal)
+			ValueStack.Push(result)
+			return
+		}
+
+		i, ok := idx.(int)
+		if !ok {
+			GfError("the index argument to 'assoc' must be an integer, not %v", idx)
+			return
+		}
+		switch x := vect.(type) {
+		case []interface{}:
+			if i < 0 || i >= len(x) {
+				GfError("index %d is out of range for a list of length %d", i, len(x))
+				return
+			}
+			result := make([]interface{}, len(x))
+			copy(result, x)
+			result[i] = newVal
+			ValueStack.Push(result)
+		case *PVector:
+			if i < 0 || i > x.Len() {
+				GfError("index %d is out of range for a vector of length %d", i, x.Len())
+				return
+			}
+			ValueStack.Push(x.Assoc(i, newVal))
+		case *PList:
+			if i < 0 || i >= x.Len() {
+				GfError("index %d is out of range for a plist of length %d", i, x.Len())
+				return
+			}
+			ValueStack.Push(x.Assoc(i, newVal))
 		default:
 			GfError("unable to index into a object of type %t using '%s'", x, idx)
 		}
@@ -2945,6 +8485,13 @@ func main() {
 			ValueStack.Push(nil)
 		}
 		switch x := vect.(type) {
+		case *Seq:
+			var head interface{}
+			x.Each(func(v interface{}) bool {
+				head = v
+				return false
+			})
+			ValueStack.Push(head)
 		case []interface{}:
 			if len(x) > 0 {
 				ValueStack.Push(x[0])
@@ -2953,10 +8500,21 @@ func main() {
 			}
 		case string:
 			if len(x) > 0 {
-				ValueStack.Push(string(x[:1]))
+				_, size := utf8.DecodeRuneInString(x)
+				ValueStack.Push(x[:size])
 			} else {
 				ValueStack.Push("")
 			}
+		case *PList:
+			ValueStack.Push(x.First())
+		case BitSet:
+			ValueStack.Push(x.First())
+		case *PVector:
+			if x.Len() > 0 {
+				ValueStack.Push(x.Nth(0))
+			} else {
+				ValueStack.Push(nil)
+			}
 		default:
 			ValueStack.Push(vect)
 		}
@@ -2979,6 +8537,19 @@ func main() {
 			} else {
 				ValueStack.Push(make([]interface{}, 0))
 			}
+		case string:
+			if len(x) > 0 {
+				_, size := utf8.DecodeRuneInString(x)
+				ValueStack.Push(x[size:])
+			} else {
+				ValueStack.Push("")
+			}
+		case *PList:
+			ValueStack.Push(x.Rest())
+		case *PVector:
+			ValueStack.Push(x.Drop(1))
+		case BitSet:
+			ValueStack.Push(x.Rest())
 		default:
 			ValueStack.Push(make([]interface{}, 0))
 		}
@@ -2998,6 +8569,12 @@ func main() {
 		}
 
 		switch x := vect.(type) {
+		case *Seq:
+			if num, ok := num.(int); ok {
+				ValueStack.Push(x.Skip(num))
+			} else {
+				GfError("the second argument to 'skip' must be an integer")
+			}
 		case []interface{}:
 			switch num := num.(type) {
 			case int:
@@ -3012,14 +8589,27 @@ func main() {
 		case string:
 			switch num := num.(type) {
 			case int:
-				if len(x) > num {
-					ValueStack.Push(string(x[num:]))
+				runes := []rune(x)
+				if len(runes) > num {
+					ValueStack.Push(string(runes[num:]))
 				} else {
-					ValueStack.Push(make([]interface{}, 0))
+					ValueStack.Push("")
 				}
 			default:
 				GfError("the second argument to 'skip' must be an integer")
 			}
+		case *PVector:
+			if num, ok := num.(int); ok {
+				ValueStack.Push(x.Drop(num))
+			} else {
+				GfError("the second argument to 'skip' must be an integer")
+			}
+		case *PList:
+			if num, ok := num.(int); ok {
+				ValueStack.Push(x.Drop(num))
+			} else {
+				GfError("the second argument to 'skip' must be an integer")
+			}
 		default:
 			GfError("the first argument to 'skip' must be a vector")
 		}
@@ -3052,14 +8642,27 @@ func main() {
 		case string:
 			switch num := num.(type) {
 			case int:
-				if len(x) > num {
-					ValueStack.Push(string(x[len(x)-num:]))
+				runes := []rune(x)
+				if len(runes) > num {
+					ValueStack.Push(string(runes[len(runes)-num:]))
 				} else {
 					ValueStack.Push(x)
 				}
 			default:
 				GfError("the second argument to 'lastn' must be an integer")
 			}
+		case *PVector:
+			if num, ok := num.(int); ok {
+				ValueStack.Push(x.Drop(x.Len() - num))
+			} else {
+				GfError("the second argument to 'lastn' must be an integer")
+			}
+		case *PList:
+			if num, ok := num.(int); ok {
+				ValueStack.Push(x.Drop(x.Len() - num))
+			} else {
+				GfError("the second argument to 'lastn' must be an integer")
+			}
 		default:
 			GfError("the first argument to 'lastn' must be a vector")
 		}
@@ -3076,7 +8679,20 @@ func main() {
 		case []interface{}:
 			ValueStack.Push(x[len(x)-1])
 		case string:
-			ValueStack.Push(string(x[len(x)-1]))
+			if len(x) > 0 {
+				_, size := utf8.DecodeLastRuneInString(x)
+				ValueStack.Push(x[len(x)-size:])
+			} else {
+				ValueStack.Push("")
+			}
+		case *PVector:
+			if x.Len() > 0 {
+				ValueStack.Push(x.Nth(x.Len() - 1))
+			} else {
+				ValueStack.Push(nil)
+			}
+		case *PList:
+			ValueStack.Push(x.Drop(x.Len() - 1).First())
 		default:
 			GfError("the first argument to 'last' must be a vector")
 		}
@@ -3113,6 +8729,10 @@ func main() {
 			} else {
 				ValueStack.Push(true)
 			}
+		case *PVector:
+			ValueStack.Push(x.Len() == 0)
+		case *PList:
+			ValueStack.Push(x.Len() == 0)
 		case string:
 			if len(x) > 0 {
 				ValueStack.Push(false)
@@ -3141,6 +8761,10 @@ func main() {
 			} else {
 				ValueStack.Push(false)
 			}
+		case *PVector:
+			ValueStack.Push(x.Len() != 0)
+		case *PList:
+			ValueStack.Push(x.Len() != 0)
 		case string:
 			if len(x) > 0 {
 				ValueStack.Push(true)
@@ -3182,7 +8806,14 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(vect); ok {
+			defer restoreListKind(vect)
+			vect = items
+		}
+
 		switch vect := vect.(type) {
+		case *Seq:
+			ValueStack.Push(vect.Map(prog))
 		case []interface{}:
 			result := make([]interface{}, 0)
 			for _, v := range vect {
@@ -3197,12 +8828,12 @@ func main() {
 				}
 			}
 			ValueStack.Push(result)
-		case map[interface{}]interface{}:
-			result := make([]interface{}, 0, len(vect))
-			for k, v := range vect {
+		case *Dict:
+			result := make([]interface{}, 0, vect.Len())
+			for _, e := range vect.Entries() {
 				pair := make([]interface{}, 2)
-				pair[0] = k
-				pair[1] = v
+				pair[0] = e.Key
+				pair[1] = e.Value
 				ValueStack.Push(pair)
 				prog()
 				val := ValueStack.Pop("progResult")
@@ -3261,7 +8892,17 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(vect); ok {
+			vect = items
+		}
+
 		switch vect := vect.(type) {
+		case *Seq:
+			vect.Each(func(v interface{}) bool {
+				ValueStack.Push(v)
+				prog()
+				return loop
+			})
 		case []interface{}:
 			for _, v := range vect {
 				ValueStack.Push(v)
@@ -3270,11 +8911,11 @@ func main() {
 					break
 				}
 			}
-		case map[interface{}]interface{}:
-			for k, v := range vect {
+		case *Dict:
+			for _, e := range vect.Entries() {
 				pair := make([]interface{}, 2)
-				pair[0] = k
-				pair[1] = v
+				pair[0] = e.Key
+				pair[1] = e.Value
 				ValueStack.Push(pair)
 				prog()
 				if !loop {
@@ -3321,7 +8962,14 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(vect); ok {
+			defer restoreListKind(vect)
+			vect = items
+		}
+
 		switch vect := vect.(type) {
+		case *Seq:
+			ValueStack.Push(vect.Filter(prog))
 		case []interface{}:
 			result := make([]interface{}, 0)
 			for _, v := range vect {
@@ -3349,6 +8997,11 @@ func main() {
 		if !loop {
 			return
 		}
+		if items, ok := persistentItems(values); ok {
+			defer restoreListKind(values)
+			values = items
+		}
+
 		switch values := values.(type) {
 		case []interface{}:
 			newlist := make([]interface{}, len(values))
@@ -3359,15 +9012,13 @@ func main() {
 				return Compare(newlist[i], newlist[j]) == -1
 			})
 			ValueStack.Push(newlist)
-		case map[interface{}]interface{}:
-			newlist := make(PairList, len(values))
-			index := 0
-			for i, v := range values {
-				newlist[index] = Pair{i, v}
-				index++
+		case *Dict:
+			newlist := make(PairList, 0, values.Len())
+			for _, e := range values.Entries() {
+				newlist = append(newlist, Pair{e.Key, e.Value})
 			}
 			sort.Sort(newlist)
-			resultlist := make([]interface{}, 0, len(values))
+			resultlist := make([]interface{}, 0, values.Len())
 			for _, v := range newlist {
 				resultlist = append(resultlist, v)
 			}
@@ -3403,6 +9054,11 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(values); ok {
+			defer restoreListKind(values)
+			values = items
+		}
+
 		switch values := values.(type) {
 		case []interface{}:
 			newlist := make([]interface{}, len(values))
@@ -3413,15 +9069,13 @@ func main() {
 				return Compare(newlist[i], newlist[j]) == 1
 			})
 			ValueStack.Push(newlist)
-		case map[interface{}]interface{}:
-			newlist := make(DescendingPairList, len(values))
-			index := 0
-			for i, v := range values {
-				newlist[index] = Pair{i, v}
-				index++
+		case *Dict:
+			newlist := make(DescendingPairList, 0, values.Len())
+			for _, e := range values.Entries() {
+				newlist = append(newlist, Pair{e.Key, e.Value})
 			}
 			sort.Sort(newlist)
-			resultlist := make([]interface{}, 0, len(values))
+			resultlist := make([]interface{}, 0, values.Len())
 			for _, v := range newlist {
 				resultlist = append(resultlist, v)
 			}
@@ -3467,6 +9121,347 @@ func main() {
 		}
 	}
 
+	//C <n> {prog} times
+	//C Runs the prog n times.
+	//C Example: 1 5 {2 *} times -> 32
+	ops["times"] = func() {
+		progVal := ValueStack.Pop("prog")
+		countVal := ValueStack.Pop("count")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("'times' requires a lambda, not '%v'", progVal)
+			return
+		}
+		count, ok := countVal.(int)
+		if !ok {
+			GfError("'times' requires an integer count, not '%v'", countVal)
+			return
+		}
+		for i := 0; i < count && loop; i++ {
+			prog()
+		}
+	}
+
+	//C <start> <end> <step> {prog} for
+	//C Runs the prog for each value from start to end, inclusive, counting by step.
+	//C The current value is pushed on the stack before each run of the prog so nested
+	//C loops each get their own index. The step may be negative but not zero.
+	//C Example: 1 10 3 {} for -> 1 4 7 10
+	//C Example: 1 2 1 {-> i 1 3 1 {@i 10 * +} for} for -> 11 12 13 21 22 23
+	ops["for"] = func() {
+		progVal := ValueStack.Pop("prog")
+		stepVal := ValueStack.Pop("step")
+		endVal := ValueStack.Pop("end")
+		startVal := ValueStack.Pop("start")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("'for' requires a lambda, not '%v'", progVal)
+			return
+		}
+
+		start, startOk := startVal.(int)
+		end, endOk := endVal.(int)
+		step, stepOk := stepVal.(int)
+		if startOk && endOk && stepOk {
+			if step == 0 {
+				GfError("the step for 'for' can't be zero")
+				return
+			}
+			for i := start; loop && ((step > 0 && i <= end) || (step < 0 && i >= end)); i += step {
+				ValueStack.Push(i)
+				prog()
+			}
+			return
+		}
+
+		fstart, startOk := toFloat(startVal)
+		fend, endOk := toFloat(endVal)
+		fstep, stepOk := toFloat(stepVal)
+		if !(startOk && endOk && stepOk) {
+			GfError("the start, end and step for 'for' must be numbers, not '%v' '%v' '%v'",
+				startVal, endVal, stepVal)
+			return
+		}
+		if fstep == 0 {
+			GfError("the step for 'for' can't be zero")
+			return
+		}
+		// Work out the count once, allowing for rounding, so the end is included
+		count := int(math.Floor((fend-fstart)/fstep+1e-9)) + 1
+		for n := 0; n < count && loop; n++ {
+			ValueStack.Push(fstart + float64(n)*fstep)
+			prog()
+		}
+	}
+
+	//C <list> {prog} each-with-index
+	//C Like 'each' but pushes both the element and its index, starting at 0, before
+	//C running the prog.
+	//C Example: ["a" "b"] {swap . .} each-with-index # Prints a 0 b 1
+	ops["each-with-index"] = func() {
+		progVal := ValueStack.Pop("prog")
+		listVal := ValueStack.Pop("list")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("'each-with-index' requires a lambda, not '%v'", progVal)
+			return
+		}
+
+		if seq, ok := listVal.(*Seq); ok {
+			i := 0
+			seq.Each(func(v interface{}) bool {
+				ValueStack.Push(v)
+				ValueStack.Push(i)
+				prog()
+				i++
+				return loop
+			})
+			return
+		}
+
+		items, ok := listItems(listVal)
+		if !ok {
+			GfError("'each-with-index' requires a list, not '%v'", listVal)
+			return
+		}
+		for i, v := range items {
+			ValueStack.Push(v)
+			ValueStack.Push(i)
+			prog()
+			if !loop {
+				break
+			}
+		}
+	}
+
+	//C <list> {prog} map-indexed -> <list>
+	//C Like 'map' but pushes both the element and its index, starting at 0, before
+	//C running the prog.
+	//C Example: [10 20 30] {*} map-indexed -> [0 20 60]
+	ops["map-indexed"] = func() {
+		progVal := ValueStack.Pop("prog")
+		listVal := ValueStack.Pop("list")
+		if !loop {
+			return
+		}
+		prog, ok := progFunc(progVal)
+		if !ok {
+			GfError("'map-indexed' requires a lambda, not '%v'", progVal)
+			return
+		}
+		items, ok := listItems(listVal)
+		if !ok {
+			GfError("'map-indexed' requires a list, not '%v'", listVal)
+			return
+		}
+
+		result := make([]interface{}, 0, len(items))
+		for i, v := range items {
+			ValueStack.Push(v)
+			ValueStack.Push(i)
+			prog()
+			val := ValueStack.Pop("progResult")
+			if !loop {
+				return
+			}
+			result = append(result, val)
+		}
+		ValueStack.Push(likeList(listVal, result))
+	}
+
+	//C {prog} nullary -> <result>
+	//C Runs the prog and pushes its result, leaving the rest of the stack as it was.
+	//C Example: 3 {dup *} nullary -> 3 9
+	ops["nullary"] = func() {
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		result := nullary(progs[0])
+		if loop {
+			ValueStack.Push(result)
+		}
+	}
+
+	//C <x> {prog} unary -> <result>
+	//C Like 'nullary' but the argument x is removed from the stack.
+	//C Example: 3 {dup *} unary -> 9
+	ops["unary"] = joyArity("unary", 1)
+
+	//C <x> <y> {prog} binary -> <result>
+	//C Like 'nullary' but the arguments x and y are removed from the stack.
+	//C Example: 3 4 {+} binary -> 7
+	ops["binary"] = joyArity("binary", 2)
+
+	//C <x> <y> <z> {prog} ternary -> <result>
+	//C Like 'nullary' but three arguments are removed from the stack.
+	ops["ternary"] = joyArity("ternary", 3)
+
+	//C <list> {prog} infra -> <list>
+	//C Runs the prog using the list as the stack, with the first element on top,
+	//C and pushes the resulting stack as a list.
+	//C Example: [3 4] {+} infra -> [7]
+	ops["infra"] = func() {
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		listVal := ValueStack.Pop("list")
+		if !loop {
+			return
+		}
+		items, ok := listItems(listVal)
+		if !ok {
+			GfError("'infra' requires a list, not '%v'", listVal)
+			return
+		}
+		saved := saveStack()
+		restoreStack(nil)
+		for i := len(items) - 1; i >= 0; i-- {
+			ValueStack.Push(items[i])
+		}
+		progs[0]()
+		result := make([]interface{}, 0, ValueStack.index)
+		for i := ValueStack.index - 1; i >= 0; i-- {
+			result = append(result, ValueStack.Value[i])
+		}
+		restoreStack(saved)
+		if loop {
+			ValueStack.Push(likeList(listVal, result))
+		}
+	}
+
+	//C {prog} [{p1} {p2} ...] construct -> <r1> <r2> ...
+	//C Runs the prog, then runs each of p1, p2 ... on the resulting stack. The
+	//C stack is then put back as it was and the results of p1, p2 ... are pushed.
+	//C Example: 3 4 {} [{+} {*}] construct -> 3 4 7 12
+	ops["construct"] = func() {
+		listVal := ValueStack.Pop("progList")
+		progs, ok := popProgs("prog")
+		if !ok {
+			return
+		}
+		items, ok := listItems(listVal)
+		if !ok {
+			GfError("'construct' requires a list of lambdas, not '%v'", listVal)
+			return
+		}
+		saved := saveStack()
+		progs[0]()
+		afterProg := saveStack()
+		results := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			prog, ok := progFunc(item)
+			if !ok {
+				GfError("'construct' requires a list of lambdas, not '%v'", item)
+				break
+			}
+			restoreStack(afterProg)
+			prog()
+			results = append(results, ValueStack.Pop("result"))
+			if !loop {
+				break
+			}
+		}
+		restoreStack(saved)
+		for _, r := range results {
+			ValueStack.Push(r)
+		}
+	}
+
+	//C {if} {then} {rec1} {rec2} genrec
+	//C General recursion. If the if-prog (run as 'nullary') is true, runs then-prog.
+	//C Otherwise runs rec1, pushes a quotation of the whole genrec and runs rec2.
+	//C Example - factorial: 5 {0 ==} {succ} {dup pred} {& *} genrec -> 120
+	ops["genrec"] = func() {
+		progs, ok := popProgs("ifProg", "thenProg", "rec1Prog", "rec2Prog")
+		if !ok {
+			return
+		}
+		genrec(progs[0], progs[1], progs[2], progs[3], activeFunction.tok)
+	}
+
+	//C {if} {then} {rec} tailrec
+	//C Tail recursion. Runs rec until the if-prog (run as 'nullary') is true,
+	//C then runs the then-prog.
+	//C Example - gcd: 48 36 {0 ==} {pop} {dup rol %} tailrec -> 12
+	ops["tailrec"] = func() {
+		progs, ok := popProgs("ifProg", "thenProg", "recProg")
+		if !ok {
+			return
+		}
+		for loop {
+			cond := nullary(progs[0])
+			if !loop {
+				return
+			}
+			if isTrue(cond) {
+				progs[1]()
+				return
+			}
+			progs[2]()
+		}
+	}
+
+	//C [[{cond1} {then1}] [{cond2} {rec1} {rec2}] ... [{default}]] condlinrec
+	//C Runs the first clause whose condition (run as 'nullary') is true. A clause
+	//C with one prog runs it and finishes; with two it runs the first, recurses and
+	//C then runs the second. The last clause has no condition and is the default.
+	//C Example - factorial: 5 [[{0 ==} {pop 1}] [{dup pred} {*}]] condlinrec -> 120
+	ops["condlinrec"] = func() {
+		listVal := ValueStack.Pop("clauses")
+		if !loop {
+			return
+		}
+		items, ok := listItems(listVal)
+		if !ok || len(items) == 0 {
+			GfError("'condlinrec' requires a non-empty list of clauses, not '%v'", listVal)
+			return
+		}
+		clauses := make([][]func(), len(items))
+		for i, item := range items {
+			parts, ok := listItems(item)
+			minParts := 2
+			if i == len(items)-1 {
+				minParts = 1
+			}
+			if !ok || len(parts) < minParts || len(parts) > minParts+1 {
+				GfError("invalid condlinrec clause '%v'", item)
+				return
+			}
+			for _, part := range parts {
+				prog, ok := progFunc(part)
+				if !ok {
+					GfError("condlinrec clauses must contain lambdas, not '%v'", part)
+					return
+				}
+				clauses[i] = append(clauses[i], prog)
+			}
+		}
+		condlinrec(clauses)
+	}
+
+	//C <tree> {leaf} {combine} treerec -> <result>
+	//C Tree recursion. If the tree isn't a list, runs the leaf-prog on it.
+	//C Otherwise pushes a quotation of the whole treerec and runs combine-prog.
+	//C Example: [1 [2 3]] {dup *} {map} treerec -> [1 [4 9]]
+	ops["treerec"] = func() {
+		progs, ok := popProgs("leafProg", "combineProg")
+		if !ok {
+			return
+		}
+		treerec(progs[0], progs[1], activeFunction.tok)
+	}
+
 	//C val {terminalProg} {aggregateProg} primrec -> <result>
 	//C Recursive combinator that takes an initial value, a terminal value generator prog
 	//C and an aggregator prog. The combinator 'decrements' the initial value until
@@ -3713,43 +9708,206 @@ func main() {
 			ValueStack.Push(val)
 		case int:
 			ValueStack.Push(float64(val))
+		case *big.Int, *big.Rat, Decimal:
+			f, _ := toFloat(val)
+			ValueStack.Push(f)
+		case complex128:
+			if imag(val) != 0 {
+				GfError("can't convert complex number '%v' with an imaginary part to float.", val)
+				return
+			}
+			ValueStack.Push(real(val))
+		case string:
+			num, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				GfError("%v", err)
+				return
+			}
+			ValueStack.Push(float64(num))
+		default:
+			GfError("can't convert '%v' of type %t to float.", val, val)
+		}
+	}
+
+	//C Force convert the value on the top of stack into an integer
+	ops["int!"] = func() {
+		val := ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+		if val == nil {
+			ValueStack.Push(0)
+			return
+		}
+
+		switch val := val.(type) {
+		case float64:
+			if math.IsInf(val, 0) || math.IsNaN(val) {
+				GfError("can't convert '%v' to an integer.", val)
+				return
+			}
+			num, _ := big.NewFloat(val).Int(nil)
+			ValueStack.Push(normalizeBig(num))
+		case int:
+			ValueStack.Push(val)
+		case *big.Int:
+			ValueStack.Push(val)
+		case *big.Rat:
+			ValueStack.Push(normalizeBig(new(big.Int).Quo(val.Num(), val.Denom())))
+		case Decimal:
+			ValueStack.Push(normalizeBig(new(big.Int).Quo(val.Unscaled, pow10(val.Scale))))
+		case string:
+			num, ok := parseInteger(strings.TrimSpace(val))
+			if !ok {
+				GfError("can't convert '%v' to an integer.", val)
+				return
+			}
+			ValueStack.Push(num)
+		default:
+			GfError("can't convert '%v' of type %t to int.", val, val)
+		}
+	}
+
+	//C Force convert the value on the top of stack into an arbitrary-precision integer.
+	//C Example: 2 big! 100 * -> 200
+	ops["big!"] = func() {
+		val := ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+
+		switch val := val.(type) {
+		case int:
+			ValueStack.Push(big.NewInt(int64(val)))
+		case *big.Int:
+			ValueStack.Push(val)
+		case float64:
+			if math.IsInf(val, 0) || math.IsNaN(val) {
+				GfError("can't convert '%v' to a big integer.", val)
+				return
+			}
+			num, _ := big.NewFloat(val).Int(nil)
+			ValueStack.Push(num)
+		case string:
+			num, ok := new(big.Int).SetString(strings.TrimSpace(val), 10)
+			if !ok {
+				GfError("can't convert '%v' to a big integer.", val)
+				return
+			}
+			ValueStack.Push(num)
+		default:
+			GfError("can't convert '%v' of type %t to a big integer.", val, val)
+		}
+	}
+
+	//C Force convert the value on the top of stack into an exact rational number.
+	//C Floats are converted using their shortest decimal representation.
+	//C Example: 1 rat! 3 / -> 1/3
+	//C Example: "0.25" rat! -> 1/4
+	ops["rat!"] = func() {
+		val := ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+
+		switch val := val.(type) {
+		case float64:
+			if math.IsInf(val, 0) || math.IsNaN(val) {
+				GfError("can't convert '%v' to a rational.", val)
+				return
+			}
+			num, _ := new(big.Rat).SetString(strconv.FormatFloat(val, 'g', -1, 64))
+			ValueStack.Push(num)
+		case string:
+			num, ok := new(big.Rat).SetString(strings.TrimSpace(val))
+			if !ok {
+				GfError("can't convert '%v' to a rational.", val)
+				return
+			}
+			ValueStack.Push(num)
+		default:
+			num, ok := toRat(val)
+			if !ok {
+				GfError("can't convert '%v' of type %t to a rational.", val, val)
+				return
+			}
+			ValueStack.Push(num)
+		}
+	}
+
+	//C Force convert the value on the top of stack into a fixed-scale decimal.
+	//C Floats are converted using their shortest decimal representation,
+	//C rationals are rounded to 10 places. See also 'dec:scale'.
+	//C Example: "19.99" dec! 3 * -> 59.97
+	ops["dec!"] = func() {
+		val := ValueStack.Pop("valToConvert")
+		if !loop {
+			return
+		}
+
+		switch val := val.(type) {
+		case float64:
+			if math.IsInf(val, 0) || math.IsNaN(val) {
+				GfError("can't convert '%v' to a decimal.", val)
+				return
+			}
+			num, _ := parseDecimal(strconv.FormatFloat(val, 'f', -1, 64))
+			ValueStack.Push(num)
 		case string:
-			num, err := strconv.ParseFloat(val, 64)
-			if err != nil {
-				GfError("%v", err)
+			num, ok := parseDecimal(val)
+			if !ok {
+				GfError("can't convert '%v' to a decimal.", val)
 				return
 			}
-			ValueStack.Push(float64(num))
+			ValueStack.Push(num)
+		case *big.Rat:
+			ValueStack.Push(ratToDecimal(val, 10))
 		default:
-			GfError("can't convert '%v' of type %t to float.", val, val)
+			num, ok := toDecimal(val)
+			if !ok {
+				GfError("can't convert '%v' of type %t to a decimal.", val, val)
+				return
+			}
+			ValueStack.Push(num)
 		}
 	}
 
-	//C Force convert the value on the top of stack into an integer
-	ops["int!"] = func() {
-		val := ValueStack.Pop("valToConvert")
+	//C <number> <scale> dec:scale -> <decimal>
+	//C Convert a number into a decimal with the specified number of places
+	//C after the decimal point, rounding half to even.
+	//C Example: 2/3 2 dec:scale -> 0.67
+	ops["dec:scale"] = func() {
+		scaleVal := ValueStack.Pop("scale")
+		val := ValueStack.Pop("valToScale")
 		if !loop {
 			return
 		}
-		if val == nil {
-			ValueStack.Push(0)
+
+		scale, ok := scaleVal.(int)
+		if !ok || scale < 0 {
+			GfError("the scale must be a non-negative integer, not %v", scaleVal)
 			return
 		}
 
 		switch val := val.(type) {
 		case float64:
-			ValueStack.Push(int(val))
-		case int:
-			ValueStack.Push(val)
-		case string:
-			num, err := strconv.Atoi(val)
-			if err != nil {
-				GfError("%v", err)
+			if math.IsInf(val, 0) || math.IsNaN(val) {
+				GfError("can't convert '%v' to a decimal.", val)
 				return
 			}
-			ValueStack.Push(float64(num))
+			num, ok := new(big.Rat).SetString(strconv.FormatFloat(val, 'g', -1, 64))
+			if !ok {
+				GfError("can't convert '%v' to a decimal.", val)
+				return
+			}
+			ValueStack.Push(ratToDecimal(num, scale))
 		default:
-			GfError("can't convert '%v' of type %t to float.", val, val)
+			num, ok := toRat(val)
+			if !ok {
+				GfError("can't convert '%v' of type %t to a decimal.", val, val)
+				return
+			}
+			ValueStack.Push(ratToDecimal(num, scale))
 		}
 	}
 
@@ -3779,6 +9937,9 @@ func main() {
 			ValueStack.Push("")
 			return
 		}
+		if items, ok := persistentItems(val); ok {
+			val = items
+		}
 		switch val := val.(type) {
 		case []interface{}:
 			// Turn a list into a string
@@ -3795,7 +9956,7 @@ func main() {
 		case string:
 			ValueStack.Push(val)
 		default:
-			GfError("The argument 'str:join' must be a list; not [%t].", val)
+			GfError("The argument 'str:join' must be a list; not '%v'.", val)
 		}
 	})
 
@@ -3844,6 +10005,56 @@ func main() {
 		}
 	}
 
+	//C "héllo" str:runes -> [104 233 108 108 111]
+	//C Returns the Unicode code points in a string as a list of integers.
+	//C Use 'explode' to get the characters as strings.
+	ops["str:runes"] = func() {
+		val := ValueStack.Pop("string")
+		if !loop {
+			return
+		}
+		str, ok := val.(string)
+		if !ok {
+			GfError("'str:runes' requires a string argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		result := make([]interface{}, 0, len(str))
+		for _, r := range str {
+			result = append(result, int(r))
+		}
+		ValueStack.Push(result)
+	}
+
+	//C "héllo" str:bytes -> b"h\xc3\xa9llo"
+	//C Returns the UTF-8 encoding of a string as a byte string. 'str:bytes len' is
+	//C the size of the string in bytes while 'len' counts characters.
+	ops["str:bytes"] = func() {
+		val := ValueStack.Pop("string")
+		if !loop {
+			return
+		}
+		str, ok := val.(string)
+		if !ok {
+			GfError("'str:bytes' requires a string argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		ValueStack.Push(Bytes(str))
+	}
+
+	//C Converts a string to Unicode normalization form C (composed characters).
+	//C Strings that look the same but were typed differently compare equal
+	//C after normalizing. See also str:nfd, str:nfkc and str:nfkd.
+	ops["str:nfc"] = normalizeOp("str:nfc", norm.NFC)
+
+	//C Converts a string to Unicode normalization form D (decomposed characters).
+	ops["str:nfd"] = normalizeOp("str:nfd", norm.NFD)
+
+	//C Converts a string to Unicode normalization form KC (compatibility composed).
+	ops["str:nfkc"] = normalizeOp("str:nfkc", norm.NFKC)
+
+	//C Converts a string to Unicode normalization form KD (compatibility decomposed).
+	ops["str:nfkd"] = normalizeOp("str:nfkd", norm.NFKD)
+
 	//C Get the ordinal code point for a character or string.
 	ops["ord"] = (func() {
 		val := ValueStack.Pop("stringToGetOrdOf")
@@ -3855,7 +10066,8 @@ func main() {
 			ValueStack.Push((int(val)))
 		case string:
 			if len(val) > 0 {
-				ValueStack.Push(int(val[0]))
+				r, _ := utf8.DecodeRuneInString(val)
+				ValueStack.Push(int(r))
 			} else {
 				ValueStack.Push(0)
 			}
@@ -3875,6 +10087,8 @@ func main() {
 		}
 
 		switch val := val.(type) {
+		case Bytes:
+			ValueStack.Push(string(val))
 		case []interface{}:
 			// Turn a list into a string
 			result := "" // Should be string builder
@@ -3940,7 +10154,22 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(vect); ok {
+			vect = items
+		}
+
 		switch vect := vect.(type) {
+		case *Seq:
+			first := true
+			vect.Each(func(v interface{}) bool {
+				ValueStack.Push(v)
+				if first {
+					first = false
+				} else {
+					prog()
+				}
+				return loop
+			})
 		case []interface{}:
 			first := true
 			for _, v := range vect {
@@ -4034,11 +10263,26 @@ func main() {
 			return
 		}
 		switch val := val.(type) {
+		case *Seq:
+			count := 0
+			val.Each(func(interface{}) bool {
+				count++
+				return true
+			})
+			ValueStack.Push(count)
 		case []interface{}:
 			ValueStack.Push(len(val))
 		case string:
-			ValueStack.Push(len(val))
-		case map[interface{}]interface{}:
+			ValueStack.Push(utf8.RuneCountInString(val))
+		case *Dict:
+			ValueStack.Push(val.Len())
+		case *PVector:
+			ValueStack.Push(val.Len())
+		case *PList:
+			ValueStack.Push(val.Len())
+		case BitSet:
+			ValueStack.Push(val.Len())
+		case Bytes:
 			ValueStack.Push(len(val))
 		case map[string]interface{}:
 			ValueStack.Push(len(val))
@@ -4058,8 +10302,12 @@ func main() {
 			ValueStack.Push(!val)
 		case string:
 			ValueStack.Push(len(val) == 0)
-		case map[interface{}]interface{}:
-			ValueStack.Push(len(val) == 0)
+		case *Dict:
+			ValueStack.Push(val.Len() == 0)
+		case *PVector:
+			ValueStack.Push(val.Len() == 0)
+		case *PList:
+			ValueStack.Push(val.Len() == 0)
 		case map[string]interface{}:
 			ValueStack.Push(len(val) == 0)
 		case []interface{}:
@@ -4069,56 +10317,471 @@ func main() {
 		}
 	}
 
-	//C Loads and executes the file named by the string on the top of stack.
-	//C The is essentially equivalent to
-	//C    "script.gf" file:read eval
-	ops["load"] = func() {
-		val := ValueStack.Pop("fileToLoad")
+	//C Loads and executes the file named by the string on the top of stack.
+	//C The is essentially equivalent to
+	//C    "script.gf" file:read eval
+	ops["load"] = func() {
+		val := ValueStack.Pop("fileToLoad")
+		if !loop {
+			return
+		}
+		switch fileToRun := val.(type) {
+		case string:
+			CallStack.Push(activeFunction.tok)
+			LoadFile(fileToRun)
+			CallStack.Pop("exitLoad")
+		default:
+			GfError("requires a string argument, not '%s' [%t]", val, val)
+		}
+	}
+
+	//C Evaluates the string on the top of stack as a GoForth program.
+	ops["eval"] = func() {
+		val := ValueStack.Pop("strToEvaluate")
+		if !loop {
+			return
+		}
+
+		var text string
+		switch val := val.(type) {
+		case string:
+			text = val
+		default:
+			text = fmt.Sprintf("%v", val)
+		}
+
+		lineno = 1
+		fields := ParseLine(string(text))
+		body := compileUnit(fields)
+		CallStack.Push(Token{
+			Text:   activeFunction.tok.Text,
+			File:   activeFunction.tok.File,
+			Name:   activeFunction.tok.Name,
+			Line:   activeFunction.tok.Line,
+			Offset: activeFunction.tok.Offset})
+		Eval(body)
+		CallStack.Pop("evalExit")
+		lineno = 1
+	}
+
+	//C "name" {block} define!
+	//C Binds a word to a block at runtime. The new word can be removed with 'forget'.
+	//C Example: "square" {dup *} define!  5 square -> 25
+	ops["define!"] = func() {
+		val := ValueStack.Pop("block")
+		nameVal := ValueStack.Pop("name")
+		if !loop {
+			return
+		}
+		name, ok := wordName(nameVal)
+		if !ok {
+			GfError("'define!' requires a string or symbol for the word name, not '%v'", nameVal)
+			return
+		}
+		block, ok := val.(op)
+		if !ok {
+			GfError("'define!' requires a block for the body of '%s', not '%v'", name, val)
+			return
+		}
+		defToken := activeFunction.tok
+		defToken.Name = name
+		defineWord(name, func() {
+			CallStack.Push(defToken)
+			block.fn()
+			CallStack.Pop("funcExit")
+		})
+	}
+
+	//C "name" forget
+	//C Removes a user-defined word along with every word defined after it,
+	//C restoring any definitions they replaced. Built-in words can't be forgotten.
+	ops["forget"] = func() {
+		val := ValueStack.Pop("name")
+		if !loop {
+			return
+		}
+		name, ok := wordName(val)
+		if !ok {
+			GfError("'forget' requires a string or symbol, not '%v'", val)
+			return
+		}
+		for i := len(definitions) - 1; i >= 0; i-- {
+			if definitions[i].name == name {
+				forgetFrom(i)
+				return
+			}
+		}
+		if _, ok := ops[name]; ok {
+			GfError("can't forget built-in word '%s'", name)
+		} else {
+			GfError("can't forget '%s'; it isn't defined", name)
+		}
+	}
+
+	//C "name" memo
+	//C <name-or-block> <arity> memo
+	//C Caches the results of a word or block by its arguments so calling it again
+	//C with the same arguments pushes the saved results instead of running it. A named
+	//C word is replaced by the cached version, so its recursive calls are cached too;
+	//C 'forget' removes the cache again. A block is replaced by a cached block. The
+	//C number of arguments comes from a DEFINE with named arguments; for other words
+	//C and for blocks it must be given. Only use 'memo' on words whose results
+	//C depend just on their arguments. See also memo:clear, memo:limit
+	//C Example: "fib" memo 80 fib
+	//C Example: {+} 2 memo -> add
+	ops["memo"] = func() {
+		target := ValueStack.Pop("target")
+		if !loop {
+			return
+		}
+		arity := -1
+		if n, ok := target.(int); ok {
+			if n < 0 {
+				GfError("the arity for 'memo' can't be negative")
+				return
+			}
+			arity = n
+			if target = ValueStack.Pop("target"); !loop {
+				return
+			}
+		}
+
+		if prog, ok := progFunc(target); ok {
+			if arity < 0 {
+				GfError("'memo' needs the number of arguments for a block, e.g. {+} 2 memo")
+				return
+			}
+			ValueStack.Push(memoize(prog, arity, "memo"))
+			return
+		}
+
+		name, ok := wordName(target)
+		if !ok {
+			GfError("'memo' requires a word name or a lambda, not '%v'", target)
+			return
+		}
+		prog, ok := progFunc(ops[name])
+		if !ok {
+			GfError("can't memo '%s'; it isn't defined", name)
+			return
+		}
+		if arity < 0 {
+			if arity, ok = wordArity[name]; !ok {
+				GfError("'memo' needs the number of arguments for '%s', e.g. \"%s\" 1 memo", name, name)
+				return
+			}
+		}
+		defineWord(name, memoize(prog, arity, name))
+	}
+
+	//C memo:clear
+	//C Empties the caches of all memoised words and blocks.
+	ops["memo:clear"] = func() {
+		memoGeneration++
+	}
+
+	//C <n> memo:limit
+	//C Limits each memo cache to n entries, dropping the oldest entries first
+	//C when a cache is full. A limit of 0 removes the limit.
+	ops["memo:limit"] = func() {
+		val := ValueStack.Pop("limit")
+		if !loop {
+			return
+		}
+		n, ok := val.(int)
+		if !ok || n < 0 {
+			GfError("'memo:limit' requires a non-negative integer, not '%v'", val)
+			return
+		}
+		memoLimit = n
+	}
+
+	//C "name" defined? -> <bool>
+	//C Returns true if there is a word or macro with this name.
+	ops["defined?"] = func() {
+		val := ValueStack.Pop("name")
+		if !loop {
+			return
+		}
+		name, ok := wordName(val)
+		if !ok {
+			GfError("'defined?' requires a string or symbol, not '%v'", val)
+			return
+		}
+		_, isWord := ops[name]
+		_, isMacro := macros[name]
+		ValueStack.Push(isWord || isMacro)
+	}
+
+	//C <val> forth:>R
+	//C Forth: moves a value from the data stack to the return stack.
+	ops["forth:>R"] = func() {
+		val := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+		ReturnStack.Push(val)
+	}
+
+	//C forth:R> -> <val>
+	//C Forth: moves a value from the return stack to the data stack.
+	ops["forth:R>"] = func() {
+		val := ReturnStack.Pop("returnStackValue")
+		if !loop {
+			return
+		}
+		ValueStack.Push(val)
+	}
+
+	//C forth:R@ -> <val>
+	//C Forth: copies the top of the return stack to the data stack.
+	ops["forth:R@"] = func() {
+		val := ReturnStack.Tos()
+		if !loop {
+			return
+		}
+		ValueStack.Push(val)
+	}
+
+	//C forth:I -> <index>
+	//C Forth: the index of the innermost DO loop.
+	ops["forth:I"] = func() {
+		if ReturnStack.index < 2 {
+			GfError("'I' can only be used inside a DO loop")
+			return
+		}
+		ValueStack.Push(ReturnStack.Value[ReturnStack.index-1])
+	}
+
+	//C forth:J -> <index>
+	//C Forth: the index of the next outer DO loop.
+	ops["forth:J"] = func() {
+		if ReturnStack.index < 4 {
+			GfError("'J' can only be used inside nested DO loops")
+			return
+		}
+		ValueStack.Push(ReturnStack.Value[ReturnStack.index-3])
+	}
+
+	//C forth:UNLOOP
+	//C Forth: discards the parameters of the innermost DO loop before an EXIT.
+	ops["forth:UNLOOP"] = func() {
+		if ReturnStack.index < 2 {
+			GfError("'UNLOOP' can only be used inside a DO loop")
+			return
+		}
+		ReturnStack.index -= 2
+	}
+
+	//C <addr> forth:@ -> <val>
+	//C Forth: fetches the value stored in a cell.
+	ops["forth:@"] = func() {
+		addr, ok := forthAddress(ValueStack.Pop("address"), "@")
+		if !loop || !ok {
+			return
+		}
+		ValueStack.Push(forthMemory[addr])
+	}
+
+	//C <val> <addr> forth:!
+	//C Forth: stores a value in a cell.
+	ops["forth:!"] = func() {
+		addrVal := ValueStack.Pop("address")
+		val := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+		if addr, ok := forthAddress(addrVal, "!"); ok {
+			forthMemory[addr] = val
+		}
+	}
+
+	//C <n> <addr> forth:+!
+	//C Forth: adds a number to the value stored in a cell.
+	ops["forth:+!"] = func() {
+		addrVal := ValueStack.Pop("address")
+		val := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+		if addr, ok := forthAddress(addrVal, "+!"); ok {
+			ValueStack.Push(forthMemory[addr])
+			ValueStack.Push(val)
+			ops["+"].(func())()
+			forthMemory[addr] = ValueStack.Pop("sum")
+		}
+	}
+
+	//C <val> forth:,
+	//C Forth: stores a value in the next free cell.
+	ops["forth:,"] = func() {
+		val := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+		forthMemory = append(forthMemory, val)
+	}
+
+	//C forth:HERE -> <addr>
+	//C Forth: the address of the next free cell.
+	ops["forth:HERE"] = func() {
+		ValueStack.Push(len(forthMemory))
+	}
+
+	//C <n> forth:ALLOT
+	//C Forth: reserves n cells, initialized to 0.
+	ops["forth:ALLOT"] = func() {
+		n, ok := forthInt(ValueStack.Pop("count"), "ALLOT")
+		if !loop || !ok {
+			return
+		}
+		for ; n > 0; n-- {
+			forthMemory = append(forthMemory, 0)
+		}
+	}
+
+	//C <n> forth:CELLS -> <n>
+	//C Forth: the size of n cells. Each cell holds one value so this is n.
+	ops["forth:CELLS"] = func() {}
+
+	//C <addr> forth:CELL+ -> <addr+1>
+	//C Forth: the address of the next cell.
+	ops["forth:CELL+"] = func() {
+		addr, ok := forthInt(ValueStack.Pop("address"), "CELL+")
+		if !loop || !ok {
+			return
+		}
+		ValueStack.Push(addr + 1)
+	}
+
+	//C <val> forth:.
+	//C Forth: prints a value followed by a space.
+	ops["forth:."] = func() {
+		val := ValueStack.Pop("valToPrint")
+		if !loop {
+			return
+		}
+		fmt.Print(val, " ")
+	}
+
+	//C <val> <width> forth:.R
+	//C Forth: prints a value right-justified in a field of the given width.
+	ops["forth:.R"] = func() {
+		width, ok := forthInt(ValueStack.Pop("width"), ".R")
+		val := ValueStack.Pop("valToPrint")
+		if !loop || !ok {
+			return
+		}
+		fmt.Printf("%*v", width, val)
+	}
+
+	//C forth:.S
+	//C Forth: prints the depth of the stack and its contents, bottom first.
+	ops["forth:.S"] = func() {
+		fmt.Printf("<%d> ", ValueStack.index)
+		for i := 0; i < ValueStack.index; i++ {
+			fmt.Print(ValueStack.Value[i], " ")
+		}
+	}
+
+	//C forth:DEPTH -> <n>
+	//C Forth: the number of values on the stack.
+	ops["forth:DEPTH"] = func() {
+		ValueStack.Push(ValueStack.index)
+	}
+
+	//C <char> forth:EMIT
+	//C Forth: prints the character with the given code.
+	ops["forth:EMIT"] = func() {
+		c, ok := forthInt(ValueStack.Pop("char"), "EMIT")
+		if !loop || !ok {
+			return
+		}
+		fmt.Print(string(rune(c)))
+	}
+
+	//C forth:CR
+	//C Forth: prints a newline.
+	ops["forth:CR"] = func() {
+		fmt.Println()
+	}
+
+	//C <n> forth:SPACES
+	//C Forth: prints n spaces.
+	ops["forth:SPACES"] = func() {
+		n, ok := forthInt(ValueStack.Pop("count"), "SPACES")
+		if !loop || !ok {
+			return
+		}
+		if n > 0 {
+			fmt.Print(strings.Repeat(" ", n))
+		}
+	}
+
+	//C <str> forth:TYPE
+	//C Forth: prints a string without a newline. Use S" text" to push the string.
+	ops["forth:TYPE"] = func() {
+		val := ValueStack.Pop("string")
 		if !loop {
 			return
 		}
-		switch fileToRun := val.(type) {
-		case string:
-			CallStack.Push(activeFunction.tok)
-			LoadFile(fileToRun)
-			CallStack.Pop("exitLoad")
-		default:
-			GfError("requires a string argument, not '%s' [%t]", val, val)
+		fmt.Print(val)
+	}
+
+	//C <n1> <n2> forth:AND -> <n>
+	//C Forth: bitwise and. Flags count as -1 (true) and 0 (false).
+	ops["forth:AND"] = forthBitOp("AND", func(a, b int) int { return a & b })
+
+	//C <n1> <n2> forth:OR -> <n>
+	//C Forth: bitwise or.
+	ops["forth:OR"] = forthBitOp("OR", func(a, b int) int { return a | b })
+
+	//C <n1> <n2> forth:XOR -> <n>
+	//C Forth: bitwise exclusive or.
+	ops["forth:XOR"] = forthBitOp("XOR", func(a, b int) int { return a ^ b })
+
+	//C <n> <count> forth:LSHIFT -> <n>
+	//C Forth: shifts n left by count bits.
+	ops["forth:LSHIFT"] = forthBitOp("LSHIFT", func(a, b int) int { return int(uint(a) << uint(b)) })
+
+	//C <n> <count> forth:RSHIFT -> <n>
+	//C Forth: shifts n right by count bits, filling with zeros.
+	ops["forth:RSHIFT"] = forthBitOp("RSHIFT", func(a, b int) int { return int(uint(a) >> uint(b)) })
+
+	//C <n> forth:INVERT -> <n>
+	//C Forth: flips all the bits of n.
+	ops["forth:INVERT"] = func() {
+		n, ok := forthInt(ValueStack.Pop("value"), "INVERT")
+		if !loop || !ok {
+			return
 		}
+		ValueStack.Push(^n)
 	}
 
-	//C Evaluates the string on the top of stack as a GoForth program.
-	ops["eval"] = func() {
-		val := ValueStack.Pop("strToEvaluate")
+	//C Read the file named by the string on the TOS and place the contents
+	//C on the stack as a single string.
+	ops["file:read"] = func() {
+		val := ValueStack.Pop("fileToRead")
 		if !loop {
 			return
 		}
 
-		var text string
-		switch val := val.(type) {
+		switch filename := val.(type) {
 		case string:
-			text = val
+			result, err := ioutil.ReadFile(filename)
+			if err != nil {
+				GfError("Error reading file: %s", err)
+				return
+			}
+			ValueStack.Push(string(result))
 		default:
-			text = fmt.Sprintf("%v", val)
+			GfError("'file:read' requires a string argument, not '%s' [%t]", val, val)
 		}
-
-		lineno = 1
-		fields := ParseLine(string(text))
-		_, body := Compile(fields, 0, "", nil)
-		CallStack.Push(Token{
-			Text:   activeFunction.tok.Text,
-			File:   activeFunction.tok.File,
-			Name:   activeFunction.tok.Name,
-			Line:   activeFunction.tok.Line,
-			Offset: activeFunction.tok.Offset})
-		Eval(body)
-		CallStack.Pop("evalExit")
-		lineno = 1
 	}
 
 	//C Read the file named by the string on the TOS and place the contents
-	//C on the stack as a single string.
-	ops["file:read"] = func() {
+	//C on the stack as a byte string.
+	ops["file:readbytes"] = func() {
 		val := ValueStack.Pop("fileToRead")
 		if !loop {
 			return
@@ -4131,10 +10794,77 @@ func main() {
 				GfError("Error reading file: %s", err)
 				return
 			}
-			ValueStack.Push(string(result))
+			ValueStack.Push(Bytes(result))
 		default:
-			GfError("'file:read' requires a string argument, not '%s' [%t]", val, val)
+			GfError("'file:readbytes' requires a string argument, not '%s' [%t]", val, val)
+		}
+	}
+
+	//C <bytes> "file.bin" file:writebytes
+	//C Write a byte string (or the UTF-8 bytes of a string) to the named file,
+	//C replacing any existing contents.
+	ops["file:writebytes"] = func() {
+		fileVal := ValueStack.Pop("fileToWrite")
+		val := ValueStack.Pop("bytesToWrite")
+		if !loop {
+			return
+		}
+
+		filename, ok := fileVal.(string)
+		if !ok {
+			GfError("'file:writebytes' requires a file name, not '%v'", fileVal)
+			return
 		}
+		var data []byte
+		switch val := val.(type) {
+		case Bytes:
+			data = val
+		case string:
+			data = []byte(val)
+		default:
+			GfError("'file:writebytes' can only write a byte string or string, not %v", reflect.TypeOf(val))
+			return
+		}
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			GfError("Error writing file: %s", err)
+		}
+	}
+
+	//C "file.txt" file:lines -> <seq>
+	//C Returns a lazy sequence of the lines in a file. The file is read as the
+	//C sequence is consumed so large files can be processed in constant memory.
+	//C Example: "log.txt" file:lines {"ERROR" str:match} filter {.} each
+	ops["file:lines"] = func() {
+		val := ValueStack.Pop("fileToReadLinesFrom")
+		if !loop {
+			return
+		}
+		filename, ok := val.(string)
+		if !ok {
+			GfError("the argument to 'file:lines' must be a file name, not %v", val)
+			return
+		}
+		ValueStack.Push(&Seq{Iter: func() *SeqIter {
+			file, err := os.Open(filename)
+			if err != nil {
+				GfError("Error reading file: %s", err)
+				return &SeqIter{Next: func() (interface{}, bool) { return nil, false }}
+			}
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+			return &SeqIter{
+				Next: func() (interface{}, bool) {
+					if !scanner.Scan() {
+						if err := scanner.Err(); err != nil {
+							GfError("Error reading file: %s", err)
+						}
+						return nil, false
+					}
+					return strings.TrimSuffix(scanner.Text(), "\r"), true
+				},
+				Stop: func() { file.Close() },
+			}
+		}})
 	}
 
 	//C Read the file named by the string on the TOS and place the contents
@@ -4462,7 +11192,19 @@ func main() {
 			return
 		}
 
+		if items, ok := persistentItems(val); ok {
+			defer restoreListKind(val)
+			val = items
+		}
+
 		switch val := val.(type) {
+		case *Seq:
+			if count < 0 {
+				GfError("'take' can't take elements from the end of a lazy sequence")
+				return
+			}
+			ValueStack.Push(val.Take(count))
+			return
 		case []interface{}:
 			if len(val) == 0 {
 				ValueStack.Push(result)
@@ -4483,6 +11225,17 @@ func main() {
 					count++
 				}
 			}
+		case string:
+			runes := []rune(val)
+			if count >= 0 {
+				if count < len(runes) {
+					runes = runes[:count]
+				}
+			} else if -count < len(runes) {
+				runes = runes[len(runes)+count:]
+			}
+			ValueStack.Push(string(runes))
+			return
 		default:
 			if count != 0 {
 				result = append(result, val)
@@ -4664,22 +11417,28 @@ func main() {
 	}
 
 	//C Turns a list into a dictionary (set) where each key is assigned true.
+	//C Keys match like Compare except that strings and numbers are never
+	//C equal, so "1" and 1 are different members even though "1" 1 == is true.
 	ops["set!"] = func() {
 		val := ValueStack.Pop("vector")
 		if !loop {
 			return
 		}
 
-		var result map[interface{}]interface{}
+		if items, ok := persistentItems(val); ok {
+			val = items
+		}
+
+		var result *Dict
 		switch val := val.(type) {
 		case []interface{}:
-			result = make(map[interface{}]interface{}, len(val))
+			result = NewDict(len(val))
 			for _, v := range val {
-				result[v] = true
+				result.Set(v, true)
 			}
 		default:
-			result = make(map[interface{}]interface{}, 1)
-			result[val] = true
+			result = NewDict(1)
+			result.Set(val, true)
 		}
 		ValueStack.Push(result)
 	}
@@ -4692,55 +11451,388 @@ func main() {
 			return
 		}
 
-		var result map[interface{}]interface{}
+		if items, ok := persistentItems(val); ok {
+			val = items
+		}
+
+		var result *Dict
 		switch val := val.(type) {
 		case []interface{}:
-			result = make(map[interface{}]interface{}, len(val))
+			result = NewDict(len(val))
 			for _, v := range val {
-				cv, ok := result[v]
+				cv, ok := result.Get(v)
 				if ok {
-					result[v] = cv.(int) + 1
+					result.Set(v, cv.(int)+1)
 				} else {
-					result[v] = 1
+					result.Set(v, 1)
 				}
 			}
 		default:
-			result = make(map[interface{}]interface{}, 1)
-			result[val] = 1
+			result = NewDict(1)
+			result.Set(val, 1)
 		}
 		ValueStack.Push(result)
 	}
 
+	//C <list> bitset! -> <set>
+	//C Converts a list of integers from 0 to 63 into a set.
+	//C Example: [1 3 5] bitset! -> #{1 3 5}
+	ops["bitset!"] = func() {
+		val := ValueStack.Pop("list")
+		if !loop {
+			return
+		}
+		if set, ok := val.(BitSet); ok {
+			ValueStack.Push(set)
+			return
+		}
+		items, ok := listItems(val)
+		if !ok {
+			GfError("'bitset!' requires a list, not '%v'", val)
+			return
+		}
+		set, ok := NewBitSet(items)
+		if !ok {
+			GfError("sets can only hold integers from 0 to %d: %v", bitSetSize-1, val)
+			return
+		}
+		ValueStack.Push(set)
+	}
+
+	//C <set> bitset:complement -> <set>
+	//C Returns the set of all the numbers from 0 to 63 that aren't in the set.
+	ops["bitset:complement"] = func() {
+		val := ValueStack.Pop("set")
+		if !loop {
+			return
+		}
+		set, ok := val.(BitSet)
+		if !ok {
+			GfError("'bitset:complement' requires a set, not '%v'", val)
+			return
+		}
+		ValueStack.Push(^set)
+	}
+
+	//C <aggregate> <val> has -> <bool>
+	//C Returns true if the list, set, dictionary or string contains the value.
+	//C Example: [1 2 3] 2 has -> true
+	ops["has"] = func() {
+		val := ValueStack.Pop("value")
+		agg := ValueStack.Pop("aggregate")
+		if !loop {
+			return
+		}
+		ValueStack.Push(aggregateHas(agg, val))
+	}
+
+	//C <val> <aggregate> in -> <bool>
+	//C Returns true if the value is in the list, set, dictionary or string.
+	//C Example: 2 [1 2 3] in -> true
+	ops["in"] = func() {
+		agg := ValueStack.Pop("aggregate")
+		val := ValueStack.Pop("value")
+		if !loop {
+			return
+		}
+		ValueStack.Push(aggregateHas(agg, val))
+	}
+
 	//C Turn an even-length list into a dictionary where alternating elements in the
-	//C list are turned into key/value pairs.
+	//C list are turned into key/value pairs. Keys match like Compare, so 1, 1.0
+	//C and 1/1 are the same key, except that strings and numbers are never equal:
+	//C "1" and 1 are different keys even though "1" 1 == is true.
 	ops["dict!"] = func() {
 		val := ValueStack.Pop("vector")
 		if !loop {
 			return
 		}
 
-		var result map[interface{}]interface{}
+		if items, ok := persistentItems(val); ok {
+			val = items
+		}
+
+		var result *Dict
 		switch val := val.(type) {
 		case []interface{}:
 			if len(val)%2 != 0 {
 				GfError("when converting a list to a dictionary, the list length must be even")
 				return
 			}
-			result = make(map[interface{}]interface{}, len(val))
+			result = NewDict(len(val) / 2)
 			iskey := true
 			var key interface{}
 			for _, v := range val {
 				if iskey {
 					key = v
 				} else {
-					result[key] = v
+					result.Set(key, v)
 				}
 				iskey = !iskey
 			}
 			ValueStack.Push(result)
 		default:
-			GfError("only a list can be converted to a dictionary")
+			GfError("only a list can be converted to a dictionary, not '%v'", val)
+		}
+	}
+
+	//C Turn a list or plist into a persistent vector. Updating a vector with
+	//C 'assoc' or '+' returns a new vector that shares structure with the original.
+	//C Example: [1 2 3] vector! -> #[1 2 3]
+	ops["vector!"] = func() {
+		val := ValueStack.Pop("vector")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *PVector:
+			ValueStack.Push(val)
+		default:
+			items, ok := listItems(val)
+			if !ok {
+				GfError("only a list can be converted to a vector, not %v", reflect.TypeOf(val))
+				return
+			}
+			ValueStack.Push(NewPVector(items))
+		}
+	}
+
+	//C Turn a list or vector into a persistent linked list. 'cons', 'uncons', 'first'
+	//C and 'rest' on a plist take constant time.
+	//C Example: [1 2 3] plist! -> (1 2 3)
+	ops["plist!"] = func() {
+		val := ValueStack.Pop("vector")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *PList:
+			ValueStack.Push(val)
+		default:
+			items, ok := listItems(val)
+			if !ok {
+				GfError("only a list can be converted to a plist, not %v", reflect.TypeOf(val))
+				return
+			}
+			ValueStack.Push(NewPList(items))
+		}
+	}
+
+	//C Turn a vector or plist back into an ordinary mutable list. The result is
+	//C always a copy.
+	ops["list!"] = func() {
+		val := ValueStack.Pop("vector")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case []interface{}:
+			result := make([]interface{}, len(val))
+			copy(result, val)
+			ValueStack.Push(result)
+		case *Dict:
+			result := make([]interface{}, 0, val.Len())
+			for _, e := range val.Entries() {
+				result = append(result, []interface{}{e.Key, e.Value})
+			}
+			ValueStack.Push(result)
+		default:
+			items, ok := persistentItems(val)
+			if !ok {
+				GfError("only a vector, plist, set or dictionary can be converted to a list, not %v", reflect.TypeOf(val))
+				return
+			}
+			ValueStack.Push(items)
+		}
+	}
+
+	//C Turn a string or a list of integers between 0 and 255 into a byte string.
+	//C A string is converted to its UTF-8 encoding. Use 'string!' to convert back.
+	//C Example: "hi" bytes! -> b"hi"
+	//C Example: [104 105] bytes! -> b"hi"
+	ops["bytes!"] = func() {
+		val := ValueStack.Pop("valueToConvert")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case Bytes:
+			result := make(Bytes, len(val))
+			copy(result, val)
+			ValueStack.Push(result)
+		case string:
+			ValueStack.Push(Bytes(val))
+		default:
+			items, ok := listItems(val)
+			if !ok {
+				GfError("only a string or a list can be converted to bytes, not %v", reflect.TypeOf(val))
+				return
+			}
+			result := make(Bytes, len(items))
+			for i, v := range items {
+				b, ok := v.(int)
+				if !ok || b < 0 || b > 255 {
+					GfError("byte values must be integers between 0 and 255, not '%v'", v)
+					return
+				}
+				result[i] = byte(b)
+			}
+			ValueStack.Push(result)
+		}
+	}
+
+	//C <bytes> bytes:hex -> <string>
+	//C Encodes a byte string as a string of hex digits.
+	//C Example: b"hi" bytes:hex -> "6869"
+	ops["bytes:hex"] = func() {
+		val := ValueStack.Pop("bytes")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case Bytes:
+			ValueStack.Push(hex.EncodeToString(val))
+		case string:
+			ValueStack.Push(hex.EncodeToString([]byte(val)))
+		default:
+			GfError("'bytes:hex' requires a byte string argument, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C <string> bytes:unhex -> <bytes>
+	//C Decodes a string of hex digits into a byte string.
+	//C Example: "6869" bytes:unhex -> b"hi"
+	ops["bytes:unhex"] = func() {
+		val := ValueStack.Pop("hexString")
+		if !loop {
+			return
+		}
+		str, ok := val.(string)
+		if !ok {
+			GfError("'bytes:unhex' requires a string argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		result, err := hex.DecodeString(str)
+		if err != nil {
+			GfError("invalid hex string '%s': %s", str, err)
+			return
+		}
+		ValueStack.Push(Bytes(result))
+	}
+
+	//C <bytes> bytes:base64 -> <string>
+	//C Encodes a byte string using standard base64 encoding.
+	//C Example: b"hi" bytes:base64 -> "aGk="
+	ops["bytes:base64"] = func() {
+		val := ValueStack.Pop("bytes")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case Bytes:
+			ValueStack.Push(base64.StdEncoding.EncodeToString(val))
+		case string:
+			ValueStack.Push(base64.StdEncoding.EncodeToString([]byte(val)))
+		default:
+			GfError("'bytes:base64' requires a byte string argument, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C <string> bytes:unbase64 -> <bytes>
+	//C Decodes a standard base64 encoded string into a byte string.
+	//C Example: "aGk=" bytes:unbase64 -> b"hi"
+	ops["bytes:unbase64"] = func() {
+		val := ValueStack.Pop("base64String")
+		if !loop {
+			return
+		}
+		str, ok := val.(string)
+		if !ok {
+			GfError("'bytes:unbase64' requires a string argument, not %v", reflect.TypeOf(val))
+			return
+		}
+		result, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			GfError("invalid base64 string '%s': %s", str, err)
+			return
+		}
+		ValueStack.Push(Bytes(result))
+	}
+
+	//C <value> <start> <end> slice -> <value>
+	//C Returns the part of a byte string, string, list or vector from index start up
+	//C to but not including index end. Negative indexes count from the end.
+	//C Example: b"hello" 1 3 slice -> b"el"
+	//C Example: [1 2 3 4 5] 1 -1 slice -> [2 3 4]
+	ops["slice"] = func() {
+		endVal := ValueStack.Pop("end")
+		startVal := ValueStack.Pop("start")
+		val := ValueStack.Pop("valueToSlice")
+		if !loop {
+			return
+		}
+		start, ok1 := startVal.(int)
+		end, ok2 := endVal.(int)
+		if !ok1 || !ok2 {
+			GfError("the start and end arguments to 'slice' must be integers")
+			return
+		}
+		switch x := val.(type) {
+		case Bytes:
+			start, end = sliceBounds(start, end, len(x))
+			result := make(Bytes, end-start)
+			copy(result, x[start:end])
+			ValueStack.Push(result)
+		case string:
+			runes := []rune(x)
+			start, end = sliceBounds(start, end, len(runes))
+			ValueStack.Push(string(runes[start:end]))
+		case []interface{}:
+			start, end = sliceBounds(start, end, len(x))
+			result := make([]interface{}, end-start)
+			copy(result, x[start:end])
+			ValueStack.Push(result)
+		default:
+			items, ok := persistentItems(val)
+			if !ok {
+				GfError("unable to slice a value of type %v", reflect.TypeOf(val))
+				return
+			}
+			start, end = sliceBounds(start, end, len(items))
+			ValueStack.Push(likeList(val, items[start:end]))
+		}
+	}
+
+	//C Turns a string into the symbol with that name.
+	//C Example: "name" symbol! -> :name
+	ops["symbol!"] = func() {
+		val := ValueStack.Pop("valueToConvert")
+		if !loop {
+			return
+		}
+		switch val := val.(type) {
+		case *Symbol:
+			ValueStack.Push(val)
+		case string:
+			ValueStack.Push(Intern(val))
+		default:
+			GfError("only a string can be converted to a symbol, not %v", reflect.TypeOf(val))
+		}
+	}
+
+	//C Gets the name of a symbol as a string.
+	//C Example: :name symbol:name -> "name"
+	ops["symbol:name"] = func() {
+		val := ValueStack.Pop("symbol")
+		if !loop {
+			return
+		}
+		sym, ok := val.(*Symbol)
+		if !ok {
+			GfError("'symbol:name' requires a symbol argument, not %v", reflect.TypeOf(val))
+			return
 		}
+		ValueStack.Push(sym.Name)
 	}
 
 	//C Turns the argument string into a regex object.
@@ -4849,7 +11941,7 @@ func main() {
 		}
 	}
 
-	LoadFile("prelude.gf")
+	LoadFile(libraryFile("prelude.gf"))
 
 	// The main REPL...
 	if len(os.Args) == 1 {
@@ -4862,6 +11954,7 @@ func main() {
 			fmt.Print("|> " + colorReset)
 
 			CallStack.Reset()
+			ReturnStack.Reset()
 			line, err := ReadLn()
 			if err != nil {
 				fmt.Println(err)
@@ -4870,7 +11963,7 @@ func main() {
 					break
 				}
 				fields := ParseLine(line)
-				_, body := Compile(fields, 0, "", nil)
+				body := compileUnit(fields)
 				ct = time.Now()
 				Eval(body)
 			}
@@ -33,7 +33,7 @@ syn keyword braidCommentTodo  TODO FIXME XXX TBD HACK NOTE BUGBUG BUGBUGBUG cont
 syn match braidComment        /(;.*;)\|#.*/ contains=goforthCommentTodo,goforthCommentDoc,@Spell
 
 " Language keywords and elements
-syn keyword goforthKeyword     DEFINE == if ifte while map each reduce repeat case primrec linrec binrec dip
+syn keyword goforthKeyword     DEFINE RECORD METHOD MACRO CONST STRICT FORTH GOFORTH EARLY-BINDING LATE-BINDING global == if ifte while map each reduce repeat case primrec linrec binrec dip
 
 syn keyword goforthConstant    true false null nil _  IsLinux IsMacOS IsWindows IsCoreCLR IsUnix tid 
 